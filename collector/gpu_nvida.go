@@ -17,14 +17,32 @@
 package collector
 
 import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
 	"log/slog"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
 )
 
 // gpuCollector collects NVIDIA GPU metrics using NVML
@@ -32,12 +50,434 @@ type gpuCollector struct {
 	logger *slog.Logger
 
 	// Prometheus metric descriptors.
-	gpuUtilizationDesc *prometheus.Desc
-	gpuTemperatureDesc *prometheus.Desc
-	gpuMemoryTotalDesc *prometheus.Desc
-	gpuMemoryUsedDesc  *prometheus.Desc
-	gpuMemoryFreeDesc  *prometheus.Desc
-	gpuInfoDesc        *prometheus.Desc
+	gpuUtilizationDesc    *prometheus.Desc
+	gpuUtilizationAvgDesc *prometheus.Desc
+	gpuUtilizationMinDesc *prometheus.Desc
+	gpuUtilizationMaxDesc *prometheus.Desc
+	gpuTemperatureDesc    *prometheus.Desc
+	gpuMemoryTotalDesc    *prometheus.Desc
+	gpuMemoryUsedDesc     *prometheus.Desc
+	gpuMemoryFreeDesc     *prometheus.Desc
+	gpuMemoryRatioDesc    *prometheus.Desc
+	gpuInfoDesc           *prometheus.Desc
+
+	gpuPowerAvgDesc     *prometheus.Desc
+	gpuPowerDesc        *prometheus.Desc
+	gpuPowerAverageDesc *prometheus.Desc
+	gpuPowerMinDesc     *prometheus.Desc
+	gpuPowerMaxDesc     *prometheus.Desc
+
+	gpuThermalSensorTemperatureDesc *prometheus.Desc
+
+	gpuCountDesc      *prometheus.Desc
+	gpuModelCountDesc *prometheus.Desc
+	gpuMissingDesc    *prometheus.Desc
+
+	gpuClocksLockedDesc *prometheus.Desc
+
+	gpuP2PStatusDesc *prometheus.Desc
+
+	gpuFabricStateDesc  *prometheus.Desc
+	gpuFabricStatusDesc *prometheus.Desc
+
+	gpuLostDesc *prometheus.Desc
+
+	gpuTemperatureMaxOperatingDesc     *prometheus.Desc
+	gpuMemoryTemperatureDesc           *prometheus.Desc
+	gpuMemoryTemperatureThrottlingDesc *prometheus.Desc
+	gpuMemoryThermalThrottleDesc       *prometheus.Desc
+
+	gpuSRAMECCThresholdExceededDesc *prometheus.Desc
+	gpuSRAMECCErrorsDesc            *prometheus.Desc
+	gpuECCSBEVolatileDesc           *prometheus.Desc
+	gpuECCDBEAggregateDesc          *prometheus.Desc
+	gpuECCRMAThresholdExceededDesc  *prometheus.Desc
+
+	gpuEnergyCounterResetsDesc *prometheus.Desc
+	gpuResetsDesc              *prometheus.Desc
+
+	gpuProcessMemoryUsedDesc  *prometheus.Desc
+	gpuTopProcessMemoryDesc   *prometheus.Desc
+	gpuOtherProcessMemoryDesc *prometheus.Desc
+	gpuUserMemoryDesc         *prometheus.Desc
+
+	gpuThermalThresholdCrossingsDesc *prometheus.Desc
+	gpuECCSBEEventsDesc              *prometheus.Desc
+
+	gpuNvLinkUtilisationDesc  *prometheus.Desc
+	gpuNvLinkLinksDesc        *prometheus.Desc
+	gpuNvLinkDownDesc         *prometheus.Desc
+	gpuNvLinkStateBitmaskDesc *prometheus.Desc
+
+	gpuPowerManagementDesc         *prometheus.Desc
+	gpuPersistenceModeDesc         *prometheus.Desc
+	gpuPersistenceModeMismatchDesc *prometheus.Desc
+	gpuPowerLimitChangesDesc       *prometheus.Desc
+	gpuPowerLimitSourceDesc        *prometheus.Desc
+	gpuIdlePowerWasteDesc          *prometheus.Desc
+	gpuBoardPowerLimitDesc         *prometheus.Desc
+	gpuBoardPowerLimitRatioDesc    *prometheus.Desc
+	gpuMPSActiveDesc               *prometheus.Desc
+	gpuPCIeAERErrorsDesc           *prometheus.Desc
+	gpuPCIeUtilisationDesc         *prometheus.Desc
+	gpuContextCountDesc            *prometheus.Desc
+	gpuProcessCountDesc            *prometheus.Desc
+	gpuTimesliceReplicasDesc       *prometheus.Desc
+	gpuWarmupDesc                  *prometheus.Desc
+	gpuScrapeSuccessDesc           *prometheus.Desc
+
+	gpuThrottleSecondsDesc         *prometheus.Desc
+	gpuThrottleRatioDesc           *prometheus.Desc
+	gpuPrimaryThrottleReasonDesc   *prometheus.Desc
+	gpuClockEventReasonScrapesDesc *prometheus.Desc
+
+	gpuAPIRestrictionDesc        *prometheus.Desc
+	gpuPowerSourceDesc           *prometheus.Desc
+	gpuDRAMBandwidthDesc         *prometheus.Desc
+	gpuDomainUtilisationDesc     *prometheus.Desc
+	gpuGPMIntegerActivityDesc    *prometheus.Desc
+	gpuExclusiveModeOccupiedDesc *prometheus.Desc
+	gpuPowerRailDesc             *prometheus.Desc
+	gpuIndexUUIDMapDesc          *prometheus.Desc
+	gpuCPUAffinityDesc           *prometheus.Desc
+	gpuGPCClockOffsetDesc        *prometheus.Desc
+	gpuMemClockOffsetDesc        *prometheus.Desc
+	gpuVFCurveMinOffsetDesc      *prometheus.Desc
+	gpuVFCurveMaxOffsetDesc      *prometheus.Desc
+	gpuFanSpeedDesc              *prometheus.Desc
+	gpuFanTargetSpeedDesc        *prometheus.Desc
+	gpuFanControlPolicyDesc      *prometheus.Desc
+	gpuVideoClockDesc            *prometheus.Desc
+	gpuVideoClockRatioDesc       *prometheus.Desc
+	gpuMaxCustomerBoostClockDesc *prometheus.Desc
+	gpuPeakFP32TFLOPSDesc        *prometheus.Desc
+	gpuEncoderSessionsDesc       *prometheus.Desc
+	gpuBusySecondsDesc           *prometheus.Desc
+	gpuMemoryReservedDesc        *prometheus.Desc
+	gpuMemoryTransferredDesc     *prometheus.Desc
+	gpuMemoryConventionDesc      *prometheus.Desc
+	gpuDriverNVMLCompatibleDesc  *prometheus.Desc
+	gpuCollectorPanicsDesc       *prometheus.Desc
+	gpuNVMLLastReturnDesc        *prometheus.Desc
+	gpuNVMLErrorsDesc            *prometheus.Desc
+	gpuTopologyChangesDesc       *prometheus.Desc
+	gpuECCConfigConsistentDesc   *prometheus.Desc
+	gpuECCRebootRequiredDesc     *prometheus.Desc
+
+	// names of the labels attached to every per-device metric
+	deviceLabels []string
+	// whether optional metrics get a supported label and a zero valued series when unsupported
+	emitUnsupported bool
+
+	// per-device state carried between scrapes, keyed by UUID
+	devicesMutex sync.Mutex
+	devices      map[string]*gpuDeviceState
+	// last UUID and gpu_index seen at each NVML index, so lost devices can still be identified
+	seen map[int]gpuSeenDevice
+	// UUIDs of the GPUs enumerated on the previous complete scrape, nil before the first one
+	present map[string]bool
+	// number of times GPUs were added or removed between scrapes
+	topologyChanges uint64
+	// number of panics recovered from while collecting a device
+	panics uint64
+	// gpu_index persisted per UUID, nil unless --collector.nvidia.index-state-file is set
+	indexState *gpuIndexState
+
+	// return code of the most recent core NVML call by category
+	lastReturns map[string]nvml.Return
+	// failed core NVML calls by category, and the number that failed during the current scrape
+	nvmlErrors   map[string]uint64
+	scrapeErrors int
+
+	// user names resolved from the passwd database by UID, cached for the lifetime of the exporter
+	userNames map[string]string
+
+	// duration of NVML calls by category, a histogram or summary depending on --collector.nvidia.call-duration-histogram
+	callDurations prometheus.ObserverVec
+
+	// counters maintained from NVML events, keyed by UUID, nil unless --collector.nvidia.events is set
+	eventsMutex sync.Mutex
+	events      map[string]*gpuEventCounts
+	eventSet    nvml.EventSet
+
+	// background poller of power and utilisation, nil unless --collector.nvidia.internal-sampler is set
+	sampler *gpuSampler
+
+	// closed by Close to stop the background goroutines, which node_exporter never does, so in
+	// the exporter they run until it exits
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+
+	// optional metric groups and the per-GPU overrides of --collector.nvidia.config-file, reloaded on SIGHUP
+	groupsMutex sync.Mutex
+	groups      gpuMetricGroups
+	config      *gpuConfig
+}
+
+// gpuMetricGroups holds which optional groups of metrics are enabled
+type gpuMetricGroups struct {
+	powerSamples       bool
+	utilisationSamples bool
+	processes          bool
+	p2p                bool
+	mps                bool
+	// memory utilisation samples integrated into bytes transferred
+	memoryTransferSamples bool
+}
+
+// gpuMetricGroupFlags maps the flags enabling optional metric groups to their fields
+var gpuMetricGroupFlags = map[string]func(*gpuMetricGroups) *bool{
+	"collector.nvidia.power-samples":           func(m *gpuMetricGroups) *bool { return &m.powerSamples },
+	"collector.nvidia.utilisation-samples":     func(m *gpuMetricGroups) *bool { return &m.utilisationSamples },
+	"collector.nvidia.processes":               func(m *gpuMetricGroups) *bool { return &m.processes },
+	"collector.nvidia.p2p":                     func(m *gpuMetricGroups) *bool { return &m.p2p },
+	"collector.nvidia.mps":                     func(m *gpuMetricGroups) *bool { return &m.mps },
+	"collector.nvidia.memory-transfer-samples": func(m *gpuMetricGroups) *bool { return &m.memoryTransferSamples },
+}
+
+// gpuDeviceState holds the values we need to remember about a device between scrapes
+type gpuDeviceState struct {
+	// whether a valid utilisation reading was taken, the first one is discarded
+	utilisationWarm bool
+
+	// outcome of the recent scrapes of the device, a ring buffer of --collector.nvidia.scrape-success-window entries
+	scrapeResults []bool
+	scrapeNext    int
+
+	// timestamp (in microseconds) of the newest sample already reported, by sampling type
+	samplesLastSeen map[nvml.SamplingType]uint64
+
+	// peak memory bandwidth in bytes per second, read once, and the bytes estimated
+	// to have been transferred from the memory utilisation samples
+	memoryBandwidth        float64
+	memoryBytesTransferred float64
+
+	// theoretical peak FP32 throughput in TFLOPS, read once
+	peakFP32TFLOPS float64
+
+	// static attributes exported by node_gpu_info, nil until they have been read
+	info *gpuStaticInfo
+
+	// maximum operating temperatures by sensor, nil until they have been read
+	maxOperatingTemps map[string]uint32
+
+	// total energy consumption (in millijoules) read on the previous scrape
+	energy     uint64
+	energySeen bool
+	// number of times the energy counter went backwards, e.g. on driver reload
+	energyResets uint64
+
+	// GPM sample taken on the previous scrape, nil until the first one was taken
+	gpmSample nvml.GpmSample
+
+	// accumulated busy time (in seconds) and when it was last advanced
+	busySeconds float64
+	busyUpdated time.Time
+
+	// enforced power limit (in milliwatts) read on the previous scrape, and how often it changed
+	powerLimit        uint32
+	powerLimitSeen    bool
+	powerLimitChanges uint64
+
+	// violation times read on the previous scrape, by throttle reason
+	violations map[string]nvml.ViolationTime
+
+	// number of scrapes each clock event reason was active in, by reason
+	clockEventReasonScrapes map[string]uint64
+
+	// NVLink data throughput counters read on the previous scrape
+	nvlinkThroughput map[gpuNvLinkCounter]gpuFieldSample
+}
+
+// gpuEventCounts are the counters of a device maintained by the event goroutine
+type gpuEventCounts struct {
+	// number of times the clocks entered a thermal slowdown
+	thermalCrossings uint64
+	// whether the clocks were in a thermal slowdown at the previous clock event
+	thermalSlowdown bool
+	// number of single bit ECC error events
+	sbeEvents uint64
+}
+
+// gpuNvLinkCounter identifies a per-link, per-direction NVLink counter
+type gpuNvLinkCounter struct {
+	link int
+	// "tx" or "rx"
+	direction string
+}
+
+// gpuFieldSample is a field value together with the time (in microseconds) NVML read it
+type gpuFieldSample struct {
+	value     float64
+	timestamp int64
+}
+
+// gpuIndexState is the gpu_index assigned to each GPU UUID, persisted to a file
+type gpuIndexState struct {
+	path    string
+	indexes map[string]int
+}
+
+// loadGPUIndexState reads the index state from path. a missing file yields an empty state,
+// as does an unreadable or corrupt one, which is also reported as an error.
+func loadGPUIndexState(path string) (*gpuIndexState, error) {
+	state := &gpuIndexState{path: path, indexes: make(map[string]int)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	var indexes map[string]int
+	if err := json.Unmarshal(data, &indexes); err != nil {
+		return state, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	used := make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		if index < 0 || used[index] {
+			return state, fmt.Errorf("invalid or duplicate index %d in %s", index, path)
+		}
+		used[index] = true
+	}
+	if indexes != nil {
+		state.indexes = indexes
+	}
+	return state, nil
+}
+
+// index returns the index of uuid, assigning it the lowest free index if it has none yet.
+// assigned reports whether the state changed and needs saving.
+func (s *gpuIndexState) index(uuid string) (index int, assigned bool) {
+	if index, ok := s.indexes[uuid]; ok {
+		return index, false
+	}
+	used := make(map[int]bool, len(s.indexes))
+	for _, index := range s.indexes {
+		used[index] = true
+	}
+	for used[index] {
+		index++
+	}
+	s.indexes[uuid] = index
+	return index, true
+}
+
+// save writes the state to its file, replacing the previous one atomically
+func (s *gpuIndexState) save() error {
+	data, err := json.MarshalIndent(s.indexes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// major number of the NVIDIA character devices, /dev/nvidia<minor> for the GPUs and
+// /dev/nvidiactl (minor 255) for the control device
+const gpuDeviceMajor = "195"
+
+// gpuCgroupDevices are the NVIDIA device minors a cgroup v1 device controller allows
+type gpuCgroupDevices struct {
+	all    bool
+	minors map[int]bool
+}
+
+// allows returns whether the cgroup may access the GPU with the given minor number
+func (d *gpuCgroupDevices) allows(minor int) bool {
+	return d.all || d.minors[minor]
+}
+
+// readGPUCgroupDevices parses the devices.list of the cgroup at path, e.g.
+//
+//	c 195:0 rw
+//	c 195:255 rw
+//
+// the device controller of cgroup v2 is an eBPF program and has no list to read
+func readGPUCgroupDevices(path string) (*gpuCgroupDevices, error) {
+	data, err := os.ReadFile(filepath.Join(path, "devices.list"))
+	if err != nil {
+		return nil, err
+	}
+	devices := &gpuCgroupDevices{minors: make(map[int]bool)}
+	for _, line := range strings.Split(string(data), "\n") {
+		// type major:minor access, a *:* rwm allows every device
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		major, minor, ok := strings.Cut(fields[1], ":")
+		if !ok || (fields[0] != "a" && fields[0] != "c") || (major != "*" && major != gpuDeviceMajor) {
+			continue
+		}
+		if minor == "*" {
+			devices.all = true
+			continue
+		}
+		if n, err := strconv.Atoi(minor); err == nil {
+			devices.minors[n] = true
+		}
+	}
+	return devices, nil
+}
+
+// gpuStaticInfo holds the attributes of a device that do not change while it is present
+type gpuStaticInfo struct {
+	serial            string
+	vbiosVersion      string
+	driverVersion     string
+	driverBranch      string
+	driverType        string
+	computeCapability string
+	architecture      string
+	brand             string
+	// CPUs closest to the GPU as a list of ranges, e.g. 0-15,32-47
+	cpuAffinity string
+}
+
+// gpuDevice is a device handle together with the values identifying it on metrics
+type gpuDevice struct {
+	nvml.Device
+
+	index int
+	// value of the gpu_index label, the persisted index with --collector.nvidia.index-state-file
+	gpuIndex string
+	uuid     string
+	pciBusID string
+	labels   []string
+	state    *gpuDeviceState
+
+	// compute processes read once per scrape for the process and exclusive mode metrics
+	computeProcesses       []nvml.ProcessInfo
+	computeProcessesReturn nvml.Return
+	computeProcessesRead   bool
+}
+
+// computeRunningProcesses returns the compute processes running on the device, reading them
+// from NVML on first use in the scrape
+func (d *gpuDevice) computeRunningProcesses() ([]nvml.ProcessInfo, nvml.Return) {
+	if !d.computeProcessesRead {
+		d.computeProcesses, d.computeProcessesReturn = d.GetComputeRunningProcesses()
+		d.computeProcessesRead = true
+	}
+	return d.computeProcesses, d.computeProcessesReturn
+}
+
+// gpuSeenDevice identifies the GPU last seen at an NVML index on node_gpu_lost, and its label
+// values for recording failed scrapes when its handle or UUID cannot be read
+type gpuSeenDevice struct {
+	uuid     string
+	gpuIndex string
+	labels   []string
+}
+
+// labelsWith returns the device label values followed by the given extra values
+func (d *gpuDevice) labelsWith(extra ...string) []string {
+	return append(slices.Clip(d.labels), extra...)
 }
 
 // namespace and subsystem for the metrics
@@ -45,148 +485,3890 @@ const (
 	gpuCollectorSubsystem = "gpu"
 )
 
+// sanity limits for values read from NVML. a wedged driver can return garbage such as
+// 0xFFFFFFFF temperatures, readings outside these limits are logged and not exported.
+const (
+	gpuMaxValidTemperature = 150
+	gpuMaxValidUtilisation = 100
+	gpuMaxValidMemoryBytes = 1 << 42
+)
+
+// maximum number of thermal sensors NVML reports per GPU (NVML_MAX_THERMAL_SENSORS_PER_GPU)
+const gpuMaxThermalSensors = 3
+
+// NVML events handled by the event goroutine, and how long (in milliseconds) it waits for one
+const (
+	gpuEventTypes       = nvml.EventTypeClock | nvml.EventTypeSingleBitEccError
+	gpuEventWaitTimeout = 1000
+)
+
+// clock event reasons set while the GPU is slowed down for temperature
+const gpuThermalSlowdownReasons = nvml.ClocksEventReasonSwThermalSlowdown | nvml.ClocksThrottleReasonHwThermalSlowdown
+
+// values of node_gpu_primary_throttle_reason
+const (
+	gpuThrottleReasonNone = iota
+	gpuThrottleReasonThermal
+	gpuThrottleReasonPower
+	gpuThrottleReasonSwCap
+	gpuThrottleReasonOther
+)
+
+// gpuPrimaryThrottleReason picks the dominant active clock event reason, in priority order:
+// thermal (software or hardware thermal slowdown), power (hardware power brake), sw_cap
+// (software power cap) and other (any remaining reason except idle)
+func gpuPrimaryThrottleReason(reasons uint64) int {
+	switch {
+	case reasons&gpuThermalSlowdownReasons != 0:
+		return gpuThrottleReasonThermal
+	case reasons&nvml.ClocksThrottleReasonHwPowerBrakeSlowdown != 0:
+		return gpuThrottleReasonPower
+	case reasons&nvml.ClocksEventReasonSwPowerCap != 0:
+		return gpuThrottleReasonSwCap
+	case reasons&^nvml.ClocksEventReasonGpuIdle != 0:
+		return gpuThrottleReasonOther
+	}
+	return gpuThrottleReasonNone
+}
+
+// values of node_gpu_power_limit_source
+const (
+	gpuPowerLimitSourceDefault = iota
+	gpuPowerLimitSourceUser
+	gpuPowerLimitSourceBrake
+)
+
+// gpuPowerLimitSource tells who is holding the GPU to its power: brake when the hardware power
+// brake or a thermal slowdown is active, user when the enforced limit differs from the default
+// limit, e.g. after nvidia-smi -pl, and default otherwise
+func gpuPowerLimitSource(enforced, defaultLimit uint32, reasons uint64) int {
+	switch {
+	case reasons&(nvml.ClocksThrottleReasonHwPowerBrakeSlowdown|gpuThermalSlowdownReasons) != 0:
+		return gpuPowerLimitSourceBrake
+	case enforced != defaultLimit:
+		return gpuPowerLimitSourceUser
+	}
+	return gpuPowerLimitSourceDefault
+}
+
+// attempts and delay between them when DeviceGetCount fails while the driver is not ready
+const (
+	gpuDeviceCountAttempts      = 3
+	gpuDeviceCountRetryInterval = 500 * time.Millisecond
+)
+
+// attempts of a list API call failing with ERROR_INSUFFICIENT_SIZE, see gpuRetryInsufficientSize
+const gpuInsufficientSizeAttempts = 3
+
+// gpuArchitectures maps NVML device architectures to label values
+var gpuArchitectures = map[nvml.DeviceArchitecture]string{
+	nvml.DEVICE_ARCH_KEPLER:  "kepler",
+	nvml.DEVICE_ARCH_MAXWELL: "maxwell",
+	nvml.DEVICE_ARCH_PASCAL:  "pascal",
+	nvml.DEVICE_ARCH_VOLTA:   "volta",
+	nvml.DEVICE_ARCH_TURING:  "turing",
+	nvml.DEVICE_ARCH_AMPERE:  "ampere",
+	nvml.DEVICE_ARCH_ADA:     "ada",
+	nvml.DEVICE_ARCH_HOPPER:  "hopper",
+}
+
+// gpuBrands maps NVML brand types to label values
+var gpuBrands = map[nvml.BrandType]string{
+	nvml.BRAND_QUADRO:              "quadro",
+	nvml.BRAND_TESLA:               "tesla",
+	nvml.BRAND_NVS:                 "nvs",
+	nvml.BRAND_GRID:                "grid",
+	nvml.BRAND_GEFORCE:             "geforce",
+	nvml.BRAND_TITAN:               "titan",
+	nvml.BRAND_NVIDIA_VAPPS:        "nvidia_vapps",
+	nvml.BRAND_NVIDIA_VPC:          "nvidia_vpc",
+	nvml.BRAND_NVIDIA_VCS:          "nvidia_vcs",
+	nvml.BRAND_NVIDIA_VWS:          "nvidia_vws",
+	nvml.BRAND_NVIDIA_CLOUD_GAMING: "nvidia_cloud_gaming",
+	nvml.BRAND_QUADRO_RTX:          "quadro_rtx",
+	nvml.BRAND_NVIDIA_RTX:          "nvidia_rtx",
+	nvml.BRAND_NVIDIA:              "nvidia",
+	nvml.BRAND_GEFORCE_RTX:         "geforce_rtx",
+	nvml.BRAND_TITAN_RTX:           "titan_rtx",
+}
+
+// gpuThermalTargets maps NVML thermal targets to label values
+var gpuThermalTargets = map[nvml.ThermalTarget]string{
+	nvml.THERMAL_TARGET_NONE:         "none",
+	nvml.THERMAL_TARGET_GPU:          "gpu",
+	nvml.THERMAL_TARGET_MEMORY:       "memory",
+	nvml.THERMAL_TARGET_POWER_SUPPLY: "power_supply",
+	nvml.THERMAL_TARGET_BOARD:        "board",
+	nvml.THERMAL_TARGET_VCD_BOARD:    "vcd_board",
+	nvml.THERMAL_TARGET_VCD_INLET:    "vcd_inlet",
+	nvml.THERMAL_TARGET_VCD_OUTLET:   "vcd_outlet",
+}
+
+// gpuThermalControllers maps NVML thermal controllers to label values
+var gpuThermalControllers = map[nvml.ThermalController]string{
+	nvml.THERMAL_CONTROLLER_NONE:            "none",
+	nvml.THERMAL_CONTROLLER_GPU_INTERNAL:    "gpu_internal",
+	nvml.THERMAL_CONTROLLER_ADM1032:         "adm1032",
+	nvml.THERMAL_CONTROLLER_ADT7461:         "adt7461",
+	nvml.THERMAL_CONTROLLER_MAX6649:         "max6649",
+	nvml.THERMAL_CONTROLLER_MAX1617:         "max1617",
+	nvml.THERMAL_CONTROLLER_LM99:            "lm99",
+	nvml.THERMAL_CONTROLLER_LM89:            "lm89",
+	nvml.THERMAL_CONTROLLER_LM64:            "lm64",
+	nvml.THERMAL_CONTROLLER_G781:            "g781",
+	nvml.THERMAL_CONTROLLER_ADT7473:         "adt7473",
+	nvml.THERMAL_CONTROLLER_SBMAX6649:       "sbmax6649",
+	nvml.THERMAL_CONTROLLER_VBIOSEVT:        "vbiosevt",
+	nvml.THERMAL_CONTROLLER_OS:              "os",
+	nvml.THERMAL_CONTROLLER_NVSYSCON_CANOAS: "nvsyscon_canoas",
+	nvml.THERMAL_CONTROLLER_NVSYSCON_E551:   "nvsyscon_e551",
+	nvml.THERMAL_CONTROLLER_MAX6649R:        "max6649r",
+	nvml.THERMAL_CONTROLLER_ADT7473S:        "adt7473s",
+}
+
+// gpuMaxOperatingThresholds are the thresholds exported as maximum operating temperatures
+var gpuMaxOperatingThresholds = []struct {
+	threshold nvml.TemperatureThresholds
+	sensor    string
+}{
+	{nvml.TEMPERATURE_THRESHOLD_GPU_MAX, "gpu"},
+	{nvml.TEMPERATURE_THRESHOLD_MEM_MAX, "memory"},
+}
+
+// number of CPUs the ideal CPU affinity of a GPU is read for
+const gpuMaxCPUs = 4096
+
+// maximum length of the process_name label in characters
+const gpuProcessNameMaxLength = 64
+
+// command name of the MPS server, nvidia-cuda-mps-server truncated to the 15 characters
+// the kernel keeps in /proc/<pid>/comm
+const gpuMPSServerName = "nvidia-cuda-mps"
+
+// gpuProcess is a process running on a GPU
+type gpuProcess struct {
+	pid uint32
+	// "compute" or "graphics"
+	kind string
+	name string
+	// id of the container the process runs in, empty outside of containers
+	containerID string
+	// real UID of the process, empty if the process has already exited
+	uid string
+	// used GPU memory in bytes, 0 when NVML cannot report it
+	usedMemory uint64
+}
+
+// gpuContainerIDRegexp matches the container id at the end of a cgroup path, for example
+// /docker/<id> or /kubepods/burstable/pod<uid>/<id> with cgroup v1 and
+// /kubepods.slice/.../cri-containerd-<id>.scope with cgroup v2 and the systemd driver
+var gpuContainerIDRegexp = regexp.MustCompile(`(?:^|[/-])([0-9a-f]{64})(?:\.scope)?$`)
+
+// gpuClockEventReasons are the clock event reasons counted by node_gpu_clocks_event_reason_total
+var gpuClockEventReasons = []struct {
+	mask   uint64
+	reason string
+}{
+	{nvml.ClocksEventReasonGpuIdle, "gpu_idle"},
+	{nvml.ClocksEventReasonApplicationsClocksSetting, "applications_clocks_setting"},
+	{nvml.ClocksEventReasonSwPowerCap, "sw_power_cap"},
+	{nvml.ClocksThrottleReasonHwSlowdown, "hw_slowdown"},
+	{nvml.ClocksEventReasonSyncBoost, "sync_boost"},
+	{nvml.ClocksEventReasonSwThermalSlowdown, "sw_thermal_slowdown"},
+	{nvml.ClocksThrottleReasonHwThermalSlowdown, "hw_thermal_slowdown"},
+	{nvml.ClocksThrottleReasonHwPowerBrakeSlowdown, "hw_power_brake_slowdown"},
+	{nvml.ClocksEventReasonDisplayClockSetting, "display_clock_setting"},
+}
+
+// gpuViolationPolicies are the performance policies whose violation (throttling) time is exported
+var gpuViolationPolicies = []struct {
+	policy nvml.PerfPolicyType
+	reason string
+}{
+	{nvml.PERF_POLICY_POWER, "power"},
+	{nvml.PERF_POLICY_THERMAL, "thermal"},
+	{nvml.PERF_POLICY_SYNC_BOOST, "sync_boost"},
+	{nvml.PERF_POLICY_BOARD_LIMIT, "board_limit"},
+	{nvml.PERF_POLICY_LOW_UTILIZATION, "low_utilisation"},
+	{nvml.PERF_POLICY_RELIABILITY, "reliability"},
+	{nvml.PERF_POLICY_TOTAL_APP_CLOCKS, "total_app_clocks"},
+	{nvml.PERF_POLICY_TOTAL_BASE_CLOCKS, "total_base_clocks"},
+}
+
+// gpuRestrictedAPIs are the APIs whose root-only restriction is exported. NVML sets memory
+// and graphics applications clocks through the same API, so set_application_clocks also
+// tells whether memory clocks can be set
+var gpuRestrictedAPIs = []struct {
+	api  nvml.RestrictedAPI
+	name string
+}{
+	{nvml.RESTRICTED_API_SET_APPLICATION_CLOCKS, "set_application_clocks"},
+	{nvml.RESTRICTED_API_SET_AUTO_BOOSTED_CLOCKS, "set_auto_boosted_clocks"},
+}
+
+// gpuPowerRails are the power scopes read through the instant power field, by rail label
+var gpuPowerRails = []struct {
+	scope uint32
+	name  string
+}{
+	{nvml.POWER_SCOPE_GPU, "gpu"},
+	{nvml.POWER_SCOPE_MODULE, "module"},
+	{nvml.POWER_SCOPE_MEMORY, "memory"},
+}
+
+// gpuNvLinkBandwidths are the data rates of a single link in one direction in bytes per
+// second by NVLink version, i.e. lanes per link times the signalling rate of a lane
+var gpuNvLinkBandwidths = map[uint32]float64{
+	1: 8 * 20e9 / 8,  // 8 lanes at 20 Gbit/s (Pascal)
+	2: 8 * 25e9 / 8,  // 8 lanes at 25 Gbit/s (Volta)
+	3: 4 * 50e9 / 8,  // 4 lanes at 50 Gbit/s (Ampere)
+	4: 2 * 100e9 / 8, // 2 lanes at 100 Gbit/s (Hopper)
+}
+
+// gpuGPMDomains are the GPM utilisation metrics exported by node_gpu_domain_utilisation_percent
+var gpuGPMDomains = []struct {
+	metric nvml.GpmMetricId
+	name   string
+}{
+	{nvml.GPM_METRIC_GRAPHICS_UTIL, "graphics"},
+	{nvml.GPM_METRIC_SM_UTIL, "sm"},
+	{nvml.GPM_METRIC_INTEGER_UTIL, "integer"},
+	{nvml.GPM_METRIC_ANY_TENSOR_UTIL, "tensor"},
+	{nvml.GPM_METRIC_FP64_UTIL, "fp64"},
+	{nvml.GPM_METRIC_FP32_UTIL, "fp32"},
+	{nvml.GPM_METRIC_FP16_UTIL, "fp16"},
+}
+
+// gpuPCIeLaneBandwidths are the data rates of a single PCIe lane in one direction in bytes per
+// second by link generation, i.e. the transfer rate less the line encoding overhead
+var gpuPCIeLaneBandwidths = map[int]float64{
+	1: 2.5e9 * 8 / 10 / 8,   // 2.5 GT/s, 8b/10b encoding
+	2: 5e9 * 8 / 10 / 8,     // 5 GT/s, 8b/10b encoding
+	3: 8e9 * 128 / 130 / 8,  // 8 GT/s, 128b/130b encoding
+	4: 16e9 * 128 / 130 / 8, // 16 GT/s, 128b/130b encoding
+	5: 32e9 * 128 / 130 / 8, // 32 GT/s, 128b/130b encoding
+	6: 64e9 * 242 / 256 / 8, // 64 GT/s, FLIT mode
+}
+
+// gpuPCIeThroughputCounters are the PCIe throughput counters (in KiB/s) by direction
+var gpuPCIeThroughputCounters = []struct {
+	counter   nvml.PcieUtilCounter
+	direction string
+}{
+	{nvml.PCIE_UTIL_TX_BYTES, "tx"},
+	{nvml.PCIE_UTIL_RX_BYTES, "rx"},
+}
+
+// gpuNvLinkThroughputFields are the data throughput counters (in KiB) by direction
+var gpuNvLinkThroughputFields = []struct {
+	field     uint32
+	direction string
+}{
+	{nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_TX, "tx"},
+	{nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_RX, "rx"},
+}
+
+// gpuAERCounters are the sysfs AER counter files by error type, and the line holding their total
+var gpuAERCounters = []struct {
+	file  string
+	total string
+	kind  string
+}{
+	{"aer_dev_correctable", "TOTAL_ERR_COR", "correctable"},
+	{"aer_dev_fatal", "TOTAL_ERR_FATAL", "fatal"},
+	{"aer_dev_nonfatal", "TOTAL_ERR_NONFATAL", "nonfatal"},
+}
+
+// gpuP2PCapabilities are the peer-to-peer capabilities queried between each pair of GPUs
+var gpuP2PCapabilities = []struct {
+	index nvml.GpuP2PCapsIndex
+	name  string
+}{
+	{nvml.P2P_CAPS_INDEX_READ, "read"},
+	{nvml.P2P_CAPS_INDEX_WRITE, "write"},
+	{nvml.P2P_CAPS_INDEX_NVLINK, "nvlink"},
+	{nvml.P2P_CAPS_INDEX_ATOMICS, "atomics"},
+	{nvml.P2P_CAPS_INDEX_PCI, "pci"},
+}
+
+// gpuLibraryFallbackPaths are where distributions and container runtimes commonly
+// install NVML when it is not on the default loader path
+var gpuLibraryFallbackPaths = []string{
+	"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1",
+	"/usr/lib/aarch64-linux-gnu/libnvidia-ml.so.1",
+	"/usr/lib64/libnvidia-ml.so.1",
+	"/usr/lib/libnvidia-ml.so.1",
+	"/usr/local/nvidia/lib64/libnvidia-ml.so.1",
+	"/run/nvidia/driver/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1",
+}
+
+var (
+	gpuPowerSamples            = kingpin.Flag("collector.nvidia.power-samples", "Enables metrics node_gpu_power_watts_{avg,min,max} summarising the power samples taken since the last scrape. Metric group flags given in an @file argument are re-read from the file on SIGHUP, flags given on the command line keep their values. SIGHUP is only handled, instead of terminating the exporter, when there is an @file argument or a --collector.nvidia.config-file.").Bool()
+	gpuUtilisationSamples      = kingpin.Flag("collector.nvidia.utilisation-samples", "Enables metric node_gpu_utilisation_avg_percentage averaging the utilisation samples taken since the last scrape.").Bool()
+	gpuLabelPCIBusID           = kingpin.Flag("collector.nvidia.label-pci-bus-id", "Add the pci_bus_id label to all GPU metrics instead of only node_gpu_info.").Bool()
+	gpuProcesses               = kingpin.Flag("collector.nvidia.processes", "Enables per-process GPU metrics such as node_gpu_process_memory_used_bytes.").Bool()
+	gpuP2P                     = kingpin.Flag("collector.nvidia.p2p", "Enables metric node_gpu_p2p_status for every pair of GPUs and capability (n*(n-1)*5 series for n GPUs).").Bool()
+	gpuExpectedCount           = kingpin.Flag("collector.nvidia.expected-count", "Number of GPUs expected on the node, enables metric node_gpu_missing when set.").Int()
+	gpuLibraryPath             = kingpin.Flag("collector.nvidia.library-path", "Path of the NVML shared library, tried before the default loader path and common install locations.").String()
+	gpuCallDurationHistogram   = kingpin.Flag("collector.nvidia.call-duration-histogram", "Export node_gpu_nvml_call_duration_seconds as a histogram instead of a summary without quantiles.").Bool()
+	gpuTopProcesses            = kingpin.Flag("collector.nvidia.top-processes", "Number of compute processes using the most GPU memory exported by node_gpu_top_process_memory_bytes per GPU, 0 disables it.").Default("5").Int()
+	gpuEvents                  = kingpin.Flag("collector.nvidia.events", "Enables metrics counted from NVML events between scrapes, node_gpu_thermal_threshold_crossings_total and node_gpu_ecc_sbe_events_total, on the GPUs supporting the events. The events are waited for in the background until the exporter exits.").Bool()
+	gpuMemoryIncludeReserved   = kingpin.Flag("collector.nvidia.memory-include-reserved", "Report memory reserved by the driver and firmware as part of node_gpu_memory_used_bytes, as NVML does. Use --no-collector.nvidia.memory-include-reserved to subtract it.").Default("true").Bool()
+	gpuIndexStateFile          = kingpin.Flag("collector.nvidia.index-state-file", "File persisting the gpu_index assigned to each GPU UUID, so the label stays stable when the enumeration order changes.").String()
+	gpuMPS                     = kingpin.Flag("collector.nvidia.mps", "Enables metric node_gpu_mps_active, detected from the MPS server among the processes running on the GPU.").Bool()
+	gpuScrapeSuccessWindow     = kingpin.Flag("collector.nvidia.scrape-success-window", "Number of recent scrapes node_gpu_scrape_success_ratio is computed over.").Default("10").Int()
+	gpuDeviceLabels            = kingpin.Flag("collector.nvidia.labels", "Comma-separated labels attached to per-device GPU metrics, out of gpu_index, gpu_name, uuid and pci_bus_id. Must include gpu_index or uuid. Without gpu_index, the metrics of a GPU whose UUID cannot be read are left out.").Default("gpu_index,gpu_name").String()
+	gpuEmitUnsupportedAsZero   = kingpin.Flag("collector.nvidia.emit-unsupported-as-zero", "Export a 0 valued series labelled supported=\"false\" for node_gpu_power_source, node_gpu_power_management_enabled, node_gpu_ecc_sbe_volatile_total, node_gpu_sram_ecc_threshold_exceeded and node_gpu_total_board_power_watts_limit on GPUs that do not support them, so the series always exist. Only these metrics are covered; other optional metrics are still omitted when unsupported. The zeros are indistinguishable from real values unless queries filter on the supported label.").Bool()
+	gpuConfigFile              = kingpin.Flag("collector.nvidia.config-file", "YAML file selecting the metric groups to collect per GPU UUID or name regex, overriding the metric group flags. Reloaded on SIGHUP.").String()
+	gpuExpectPersistence       = kingpin.Flag("collector.nvidia.expect-persistence", "Expected persistence mode of every GPU (on or off), enables metric node_gpu_persistence_mode_mismatch when set.").Enum("on", "off")
+	gpuMemoryTransferSamples   = kingpin.Flag("collector.nvidia.memory-transfer-samples", "Enables metric node_gpu_memory_bytes_transferred_total, estimated by integrating the memory utilisation samples over the peak memory bandwidth.").Bool()
+	gpuInternalSampler         = kingpin.Flag("collector.nvidia.internal-sampler", "Poll the power and utilisation of every GPU in the background and export node_gpu_power_watts_{avg,min,max} and node_gpu_utilisation_{avg,min,max}_percentage over the polls since the last scrape, instead of the NVML sample buffers of --collector.nvidia.power-samples and --collector.nvidia.utilisation-samples. The sampler runs until the exporter exits.").Bool()
+	gpuInternalSamplerInterval = kingpin.Flag("collector.nvidia.internal-sampler-interval", "Interval the internal sampler polls the GPUs at.").Default("100ms").Duration()
+	gpuTimesliceLabelsFile     = kingpin.Flag("collector.nvidia.timeslice-labels-file", "Node feature discovery feature file, e.g. /etc/kubernetes/node-feature-discovery/features.d/gfd, whose nvidia.com/gpu.replicas label is exported as node_gpu_timeslice_replicas.").String()
+	gpuErrorPolicy             = kingpin.Flag("collector.nvidia.error-policy", "How failed per-device NVML calls affect the scrape: ignore them, count them in node_gpu_nvml_errors_total, or count them and report the nvidia collector as failed in node_scrape_collector_success. Reads the GPU does not support are never errors.").Default("count").Enum("ignore", "count", "fail")
+	gpuCgroup                  = kingpin.Flag("collector.nvidia.cgroup", "Path of a cgroup v1 device controller cgroup, e.g. of a container. Only the GPUs whose /dev/nvidia<minor> its devices.list allows are reported.").String()
+	gpuIdlePowerThreshold      = kingpin.Flag("collector.nvidia.idle-power-threshold", "Power draw in watts above which an idle GPU is reported by node_gpu_idle_power_waste.").Default("50").Float64()
+	gpuECCRMAThreshold         = kingpin.Flag("collector.nvidia.ecc-rma-threshold", "Lifetime double bit ECC error count above which node_gpu_ecc_rma_threshold_exceeded is set. The default follows the NVIDIA RMA policy of 60 retired pages, as every double bit error retires a page.").Default("60").Uint()
+	gpuSelfTest                = kingpin.Flag("collector.nvidia.selftest", "Check that NVML is usable, report which GPU metrics can be read and exit.").Action(gpuSelfTestAction).Bool()
+)
+
 // init and add the collector
 func init() {
 	registerCollector("nvidia", defaultEnabled, NewGPUCollector)
 }
 
-// NewGPUCollector creates a new GPU collector and initialises NVML
-// returns an error if NVML cannot be initialised
+// gpuMemoryConvention describes whether reserved memory is counted as used memory
+func gpuMemoryConvention() string {
+	if *gpuMemoryIncludeReserved {
+		return "including memory reserved by the driver and firmware"
+	}
+	return "excluding memory reserved by the driver and firmware"
+}
+
+// gpuInitNVML initialises NVML, loading the library from --collector.nvidia.library-path,
+// the default loader path or the first fallback location it is found at
+func gpuInitNVML(logger *slog.Logger) nvml.Return {
+	// the bare library name is resolved through the default loader path
+	paths := append([]string{"libnvidia-ml.so.1"}, gpuLibraryFallbackPaths...)
+	if *gpuLibraryPath != "" {
+		paths = append([]string{*gpuLibraryPath}, paths...)
+	}
+
+	ret := nvml.ERROR_LIBRARY_NOT_FOUND
+	for _, path := range paths {
+		if err := nvml.SetLibraryOptions(nvml.WithLibraryPath(path)); err != nil {
+			// the library is already loaded, e.g. by an earlier initialisation
+			return nvml.Init()
+		}
+		if ret = nvml.Init(); ret != nvml.ERROR_LIBRARY_NOT_FOUND {
+			if ret == nvml.SUCCESS {
+				logger.Info("loaded NVML library", "path", path)
+			}
+			return ret
+		}
+		logger.Debug("NVML library not found", "path", path)
+	}
+	return ret
+}
+
+// gpuNVMLInitSuccessDesc is exported by both the GPU collector and its disabled stand-in
+var gpuNVMLInitSuccessDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvml_init_success"),
+	"Whether NVML was initialised at startup, 0 when the collector is disabled on a node without a usable NVIDIA driver.",
+	nil, nil,
+)
+
+// gpuDisabledCollector stands in for the GPU collector when NVML cannot be initialised, e.g. on
+// nodes without NVIDIA GPUs or drivers, so one binary can be deployed fleet-wide
+type gpuDisabledCollector struct{}
+
+// Update implements the Collector interface
+func (gpuDisabledCollector) Update(ch chan<- prometheus.Metric) error {
+	ch <- prometheus.MustNewConstMetric(gpuNVMLInitSuccessDesc, prometheus.GaugeValue, 0)
+	return nil
+}
+
+// NewGPUCollector creates a new GPU collector and initialises NVML. when NVML cannot be
+// initialised the error is logged once and a disabled collector is returned instead
 func NewGPUCollector(logger *slog.Logger) (Collector, error) {
+	deviceLabels, err := parseGPULabels(*gpuDeviceLabels, *gpuLabelPCIBusID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --collector.nvidia.labels: %w", err)
+	}
+	var config *gpuConfig
+	if *gpuConfigFile != "" {
+		if config, err = loadGPUConfig(*gpuConfigFile); err != nil {
+			return nil, fmt.Errorf("could not load %s: %w", *gpuConfigFile, err)
+		}
+	}
+
+	if *gpuInternalSampler && *gpuInternalSamplerInterval <= 0 {
+		return nil, fmt.Errorf("invalid --collector.nvidia.internal-sampler-interval %s: must be positive", *gpuInternalSamplerInterval)
+	}
+
 	// initialise NVML
-	ret := nvml.Init()
+	ret := gpuInitNVML(logger)
 	if ret != nvml.SUCCESS {
-		return nil, fmt.Errorf("could not initialise NVML: %v", ret)
+		logger.Warn("could not initialise NVML, the nvidia collector is disabled", "return", ret)
+		return gpuDisabledCollector{}, nil
+	}
+
+	g := newGPUCollector(logger, deviceLabels)
+	g.config = config
+	if *gpuIndexStateFile != "" {
+		state, err := loadGPUIndexState(*gpuIndexStateFile)
+		if err != nil {
+			logger.Warn("failed to load GPU index state, assigning indexes afresh", "path", *gpuIndexStateFile, "err", err)
+		}
+		g.indexState = state
+	}
+	if gpuArgsFromFile(os.Args[1:]) || *gpuConfigFile != "" {
+		g.running.Add(1)
+		go func() {
+			defer g.running.Done()
+			g.reloadOnSIGHUP(g.stop)
+		}()
+	}
+	if *gpuInternalSampler {
+		g.startSampler(*gpuInternalSamplerInterval)
+	}
+	if *gpuEvents {
+		if err := g.startEvents(); err != nil {
+			logger.Warn("failed to watch GPU events, event counters are disabled", "err", err)
+		}
+	}
+
+	return g, nil
+}
+
+// newGPUCollector creates the GPU collector and its metric descriptors, NVML must already be initialised.
+// deviceLabels are the labels attached to every per-device metric, as returned by parseGPULabels.
+func newGPUCollector(logger *slog.Logger, deviceLabels []string) *gpuCollector {
+	withLabels := func(extra ...string) []string {
+		return append(slices.Clip(deviceLabels), extra...)
+	}
+	// labels of the metrics exported as zero on GPUs that do not support them
+	optionalLabels := deviceLabels
+	if *gpuEmitUnsupportedAsZero {
+		optionalLabels = withLabels("supported")
 	}
 
 	// create metric descriptors
 	g := &gpuCollector{
-		logger: logger,
+		logger:          logger,
+		deviceLabels:    deviceLabels,
+		emitUnsupported: *gpuEmitUnsupportedAsZero,
 		gpuUtilizationDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "utilisation_percentage"),
 			"GPU utilisation in percent.",
-			[]string{"gpu_index", "gpu_name"}, nil,
+			deviceLabels, nil,
+		),
+		gpuUtilizationAvgDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "utilisation_avg_percentage"),
+			"Average GPU utilisation in percent over the samples taken since the last scrape.",
+			deviceLabels, nil,
 		),
 		gpuTemperatureDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "temperature_celsius"),
 			"GPU temperature in Celsius.",
-			[]string{"gpu_index", "gpu_name"}, nil,
+			deviceLabels, nil,
 		),
 		gpuMemoryTotalDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_total_bytes"),
 			"Total GPU memory in bytes.",
-			[]string{"gpu_index", "gpu_name"}, nil,
+			deviceLabels, nil,
 		),
 		gpuMemoryUsedDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_used_bytes"),
-			"Used GPU memory in bytes.",
-			[]string{"gpu_index", "gpu_name"}, nil,
+			"Used GPU memory in bytes, "+gpuMemoryConvention()+".",
+			deviceLabels, nil,
 		),
 		gpuMemoryFreeDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_free_bytes"),
 			"Free GPU memory in bytes.",
-			[]string{"gpu_index", "gpu_name"}, nil,
+			deviceLabels, nil,
+		),
+		gpuMemoryRatioDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_used_ratio"),
+			"Ratio of used to total GPU memory (0-1).",
+			deviceLabels, nil,
 		),
 		gpuInfoDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "info"),
-			"Static GPU information (e.g. index and name).",
-			[]string{"gpu_index", "gpu_name"}, nil,
+			"Static GPU information.",
+			[]string{"gpu_index", "gpu_name", "uuid", "pci_bus_id", "serial", "vbios_version", "driver_version", "driver_branch", "driver_type", "compute_capability", "architecture", "brand"}, nil,
 		),
-	}
-
-	return g, nil
-}
-
-// update collects GPU metrics using NVML and sends them to the prometheus metric channel
-func (g *gpuCollector) Update(ch chan<- prometheus.Metric) error {
-	// retrieve the number of NVIDIA GPUs
-	count, ret := nvml.DeviceGetCount()
-	if ret != nvml.SUCCESS {
-		g.logger.Error("failed to get GPU count", "return", ret)
-		return fmt.Errorf("could not retrieve GPU count: %v", ret)
-	}
-	if count == 0 {
-		return errors.New("no NVIDIA GPUs found")
-	}
-
-	for i := 0; i < count; i++ {
-		device, ret := nvml.DeviceGetHandleByIndex(i)
-		if ret != nvml.SUCCESS {
-			g.logger.Warn("failed to get handle for GPU device", "gpu_index", i, "return", ret)
-			continue
-		}
-
-		// retrieve the GPU name
-		name, ret := device.GetName()
-		if ret != nvml.SUCCESS {
-			g.logger.Warn("failed to get GPU name", "gpu_index", i, "return", ret)
-			name = "unknown"
-		}
-
-		// retrieve GPU utilization rates
-		util, ret := device.GetUtilizationRates()
-		if ret != nvml.SUCCESS {
-			g.logger.Warn("failed to get GPU utilization", "gpu_index", i, "return", ret)
-			continue
-		}
-
-		// retrieve GPU temperature
-		temp, ret := device.GetTemperature(nvml.TEMPERATURE_GPU)
-		if ret != nvml.SUCCESS {
-			g.logger.Warn("failed to get GPU temperature", "gpu_index", i, "return", ret)
-			continue
-		}
-
-		// retrieve GPU memory info
-		mem, ret := device.GetMemoryInfo()
-		if ret != nvml.SUCCESS {
-			g.logger.Warn("failed to get GPU memory info", "gpu_index", i, "return", ret)
-			continue
-		}
-
-		gpuIndex := strconv.Itoa(i)
-
-		gpuUtilization := float64(util.Gpu)
-
-		// export metrics
-		ch <- prometheus.MustNewConstMetric(
-			g.gpuUtilizationDesc,
-			prometheus.GaugeValue,
-			gpuUtilization,
-			gpuIndex, name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			g.gpuTemperatureDesc,
-			prometheus.GaugeValue,
-			float64(temp),
-			gpuIndex, name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			g.gpuMemoryTotalDesc,
-			prometheus.GaugeValue,
-			float64(mem.Total),
-			gpuIndex, name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			g.gpuMemoryUsedDesc,
-			prometheus.GaugeValue,
-			float64(mem.Used),
-			gpuIndex, name,
-		)
+		gpuPowerAvgDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_watts_avg"),
+			"Average GPU power draw in watts over the samples taken since the last scrape.",
+			deviceLabels, nil,
+		),
+		gpuPowerMinDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_watts_min"),
+			"Minimum GPU power draw in watts over the samples taken since the last scrape.",
+			deviceLabels, nil,
+		),
+		gpuPowerMaxDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_watts_max"),
+			"Maximum GPU power draw in watts over the samples taken since the last scrape.",
+			deviceLabels, nil,
+		),
+		gpuThermalSensorTemperatureDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "thermal_sensor_temperature_celsius"),
+			"Temperature in Celsius reported by each GPU thermal sensor.",
+			withLabels("sensor", "controller", "target"), nil,
+		),
+		gpuCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "count"),
+			"Number of NVIDIA GPUs found by NVML, excluding the ones --collector.nvidia.cgroup may not access.",
+			nil, nil,
+		),
+		gpuModelCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "model_count"),
+			"Number of NVIDIA GPUs found by NVML per model.",
+			[]string{"gpu_name"}, nil,
+		),
+		gpuMissingDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "missing"),
+			"Number of GPUs expected via --collector.nvidia.expected-count that NVML did not find.",
+			nil, nil,
+		),
+		gpuClocksLockedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "clocks_locked"),
+			"Whether the GPU clocks are limited by locked or applications clocks (e.g. nvidia-smi -lgc / -ac). NVML reports no locked clock range, so locked clocks are only seen while they hold the clocks back, i.e. under load. Applications clocks differing from the defaults are seen at any time.",
+			deviceLabels, nil,
+		),
+		gpuP2PStatusDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "p2p_status"),
+			"Whether the peer-to-peer capability between the GPU and its peer is available (1) or not (0).",
+			withLabels("peer_index", "capability"), nil,
+		),
+		gpuFabricStateDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "fabric_state"),
+			"State of the GPU registration with the NVLink fabric manager (1 = not started, 2 = in progress, 3 = completed).",
+			withLabels("cluster_uuid"), nil,
+		),
+		gpuFabricStatusDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "fabric_status"),
+			"NVML return code of the GPU registration with the NVLink fabric manager (0 = success).",
+			withLabels("cluster_uuid"), nil,
+		),
+		gpuLostDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "lost"),
+			"Whether NVML reports the GPU as lost (fallen off the bus).",
+			[]string{"gpu_index", "uuid"}, nil,
+		),
+		gpuTemperatureMaxOperatingDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "temperature_max_operating_celsius"),
+			"Maximum operating temperature of the GPU or its memory in Celsius.",
+			withLabels("sensor"), nil,
+		),
+		gpuSRAMECCThresholdExceededDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "sram_ecc_threshold_exceeded"),
+			"Whether the SRAM ECC error threshold requiring an RMA has been exceeded.",
+			optionalLabels, nil,
+		),
+		gpuSRAMECCErrorsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "sram_ecc_errors_total"),
+			"Aggregate number of SRAM ECC errors over the lifetime of the GPU by type.",
+			withLabels("type"), nil,
+		),
+		gpuEnergyCounterResetsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "energy_counter_reset_total"),
+			"Number of times the GPU total energy counter was seen to decrease, which happens when the driver is reloaded.",
+			deviceLabels, nil,
+		),
+		gpuProcessMemoryUsedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "process_memory_used_bytes"),
+			"GPU memory used by each process running on the GPU in bytes.",
+			withLabels("pid", "process_name", "type", "container_id"), nil,
+		),
+		gpuThrottleSecondsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "throttle_seconds_total"),
+			"Time the GPU clocks were held below their target due to each policy in seconds.",
+			withLabels("reason"), nil,
+		),
+		gpuAPIRestrictionDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "api_restriction"),
+			"Whether the API is restricted to root users (1) or available to all users (0); set_application_clocks covers both memory and graphics clocks.",
+			withLabels("api"), nil,
+		),
+		gpuPowerSourceDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_source"),
+			"Power source of the GPU (0 = AC, 1 = battery, 2 = undersized).",
+			optionalLabels, nil,
+		),
+		gpuDRAMBandwidthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "dram_bandwidth_utilisation_percentage"),
+			"DRAM bandwidth utilisation of the GPU, read from GPM metrics where supported and from the memory utilisation rate otherwise.",
+			withLabels("source"), nil,
+		),
+		gpuExclusiveModeOccupiedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "exclusive_mode_occupied"),
+			"Whether the GPU is in exclusive process compute mode and already has a compute process, so new contexts will be rejected.",
+			deviceLabels, nil,
+		),
+		gpuPowerRailDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_rail_watts"),
+			"Instant power draw in watts of a power rail on boards that report power per rail.",
+			withLabels("rail"), nil,
+		),
+		gpuIndexUUIDMapDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "index_uuid_map"),
+			"Mapping of NVML device indexes to GPU UUIDs, for joining index and UUID labelled series.",
+			[]string{"gpu_index", "uuid"}, nil,
+		),
+		gpuGPCClockOffsetDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "gpc_clock_offset_hertz"),
+			"Offset applied to the GPC clock voltage/frequency curve in hertz.",
+			deviceLabels, nil,
+		),
+		gpuMemClockOffsetDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "mem_clock_offset_hertz"),
+			"Offset applied to the memory clock voltage/frequency curve in hertz.",
+			deviceLabels, nil,
+		),
+		gpuEncoderSessionsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "encoder_sessions"),
+			"Number of active NVENC encoder sessions. NVML has no session API for NVDEC, so decoder sessions are not reported.",
+			deviceLabels, nil,
+		),
+		gpuBusySecondsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "busy_seconds_total"),
+			"Approximate time the GPU spent busy, accumulated from the utilisation reading of each scrape over the interval since the previous one.",
+			deviceLabels, nil,
+		),
+		gpuMemoryReservedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_reserved_bytes"),
+			"GPU memory in bytes reserved by the driver and firmware, including ECC, and not allocatable by applications.",
+			deviceLabels, nil,
+		),
+		gpuECCConfigConsistentDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "ecc_config_consistent"),
+			"Whether all GPUs reporting an ECC mode have the same current ECC mode (1) or not (0).",
+			nil, nil,
+		),
+		gpuTopProcessMemoryDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "top_process_memory_bytes"),
+			"GPU memory in bytes used by the compute processes using the most memory on the GPU.",
+			withLabels("pid", "process_name"), nil,
+		),
+		gpuOtherProcessMemoryDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "other_process_memory_bytes"),
+			"GPU memory in bytes used by the compute processes not exported by node_gpu_top_process_memory_bytes.",
+			deviceLabels, nil,
+		),
+		gpuThermalThresholdCrossingsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "thermal_threshold_crossings_total"),
+			"Number of times the GPU clocks entered a thermal slowdown, counted from NVML clock change events. The slowdown reasons are read when the event is handled, so a slowdown that already ended by then is not counted.",
+			deviceLabels, nil,
+		),
+		gpuECCSBEEventsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "ecc_sbe_events_total"),
+			"Number of single bit ECC error events NVML delivered for the GPU.",
+			deviceLabels, nil,
+		),
+		gpuNvLinkUtilisationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvlink_utilisation_percent"),
+			"Data throughput of an NVLink since the previous scrape as a percentage of the link bandwidth in that direction.",
+			withLabels("link", "direction"), nil,
+		),
+		gpuNvLinkLinksDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvlink_links"),
+			"Number of NVLinks the GPU reports a state for.",
+			deviceLabels, nil,
+		),
+		gpuNvLinkDownDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvlink_down_count"),
+			"Number of NVLinks of the GPU that are inactive.",
+			deviceLabels, nil,
+		),
+		gpuPowerManagementDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_management_enabled"),
+			"Whether power management, and with it power limits, is enabled on the GPU.",
+			optionalLabels, nil,
+		),
+		gpuThrottleRatioDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "clocks_throttle_ratio"),
+			"Fraction of the time since the previous scrape the GPU clocks were held below their target due to each policy.",
+			withLabels("reason"), nil,
+		),
+		gpuMemoryConventionDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_convention"),
+			"Whether node_gpu_memory_used_bytes includes reserved memory, set by --collector.nvidia.memory-include-reserved.",
+			[]string{"convention"}, nil,
+		),
+		gpuCollectorPanicsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "collector_panics_total"),
+			"Number of panics recovered from while collecting the metrics of a GPU.",
+			nil, nil,
+		),
+		gpuPowerLimitChangesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_limit_changed_total"),
+			"Number of scrapes at which the enforced power limit differed from the previous scrape.",
+			deviceLabels, nil,
+		),
+		gpuMPSActiveDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "mps_active"),
+			"Whether an MPS server is running on the GPU, multiplexing the compute processes of its clients.",
+			deviceLabels, nil,
+		),
+		gpuPCIeAERErrorsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "pcie_aer_errors_total"),
+			"Number of PCIe errors the kernel's Advanced Error Reporting logged for the GPU, by severity.",
+			withLabels("type"), nil,
+		),
+		gpuContextCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "context_count"),
+			"Number of processes with a context on the GPU, by type of context. NVML lists a process once per type however many contexts it holds, so this does not count the contexts of a process separately.",
+			withLabels("type"), nil,
+		),
+		gpuWarmupDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "warmup"),
+			"Whether the utilisation reading of this scrape was discarded as the first one taken for the GPU.",
+			deviceLabels, nil,
+		),
+		gpuScrapeSuccessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "scrape_success_ratio"),
+			"Fraction of the recent scrapes, up to --collector.nvidia.scrape-success-window, in which the core readings of the GPU succeeded.",
+			deviceLabels, nil,
+		),
+		gpuResetsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "reset_total"),
+			"Number of GPU resets seen since the collector started, inferred from the given source.",
+			withLabels("source"), nil,
+		),
+		gpuECCSBEVolatileDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "ecc_sbe_volatile_total"),
+			"Number of corrected single bit ECC errors since the driver was last loaded.",
+			optionalLabels, nil,
+		),
+		gpuPrimaryThrottleReasonDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "primary_throttle_reason"),
+			"Dominant reason the GPU clocks are held back: 0=none, 1=thermal, 2=power, 3=sw_cap, 4=other, picked in that priority order.",
+			deviceLabels, nil,
+		),
+		gpuTopologyChangesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "topology_changes_total"),
+			"Number of times GPUs were added or removed since the collector started.",
+			nil, nil,
+		),
+		gpuPCIeUtilisationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "pcie_utilisation_percent"),
+			"PCIe throughput over the last 20ms as a percentage of the bandwidth of the current link generation and width in that direction.",
+			withLabels("direction"), nil,
+		),
+		gpuBoardPowerLimitDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "total_board_power_watts_limit"),
+			"Power limit of the whole GPU module (total graphics power) in watts.",
+			optionalLabels, nil,
+		),
+		gpuBoardPowerLimitRatioDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "enforced_power_limit_board_ratio"),
+			"Enforced GPU power limit as a ratio of the total board power limit.",
+			deviceLabels, nil,
+		),
+		gpuDomainUtilisationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "domain_utilisation_percent"),
+			"Utilisation of a GPU domain between this scrape and the previous one in percent, from GPM.",
+			withLabels("domain"), nil,
+		),
+		gpuMemoryTemperatureDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_temperature_celsius"),
+			"GPU memory (HBM) temperature in Celsius.",
+			deviceLabels, nil,
+		),
+		gpuMemoryTemperatureThrottlingDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_temperature_throttling"),
+			"Whether the GPU memory temperature has reached the memory maximum operating temperature, above which the memory is slowed down.",
+			deviceLabels, nil,
+		),
+		gpuNVMLLastReturnDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvml_last_return_code"),
+			"NVML return code of the most recent call of each category of core readings (0 = success, 3 = not supported, 15 = GPU is lost).",
+			[]string{"call"}, nil,
+		),
+		gpuNvLinkStateBitmaskDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvlink_state_bitmask"),
+			"NVLink states as a bitmask, bit i is set when link i is up.",
+			deviceLabels, nil,
+		),
+		gpuCPUAffinityDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "ideal_cpu_affinity_info"),
+			"CPUs closest to the GPU, jobs using the GPU are best pinned to them.",
+			withLabels("cpulist"), nil,
+		),
+		gpuPersistenceModeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "persistence_mode"),
+			"Whether persistence mode is enabled on the GPU.",
+			deviceLabels, nil,
+		),
+		gpuPersistenceModeMismatchDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "persistence_mode_mismatch"),
+			"Whether the persistence mode of the GPU differs from --collector.nvidia.expect-persistence.",
+			deviceLabels, nil,
+		),
+		gpuClockEventReasonScrapesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "clocks_event_reason_total"),
+			"Number of scrapes in which the clock event reason was active. Counts scrapes, not time.",
+			withLabels("reason"), nil,
+		),
+		gpuPowerDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_watts"),
+			"Instant GPU power draw in watts.",
+			deviceLabels, nil,
+		),
+		gpuPowerAverageDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_average_watts"),
+			"GPU power draw in watts averaged by the driver over the last second, or the instant power draw on GPUs without an average.",
+			deviceLabels, nil,
+		),
+		gpuVideoClockDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "video_clock_hertz"),
+			"Current video engine clock in hertz.",
+			deviceLabels, nil,
+		),
+		gpuVideoClockRatioDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "video_clock_ratio"),
+			"Current video engine clock as a ratio of the maximum video clock.",
+			deviceLabels, nil,
+		),
+		gpuMemoryTransferredDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_bytes_transferred_total"),
+			"Estimated bytes read from and written to GPU memory, integrating the memory utilisation samples over the peak memory bandwidth.",
+			deviceLabels, nil,
+		),
+		gpuECCRebootRequiredDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "ecc_reboot_required"),
+			"Whether the pending ECC mode differs from the current one, so the change only takes effect after a reboot.",
+			deviceLabels, nil,
+		),
+		gpuUserMemoryDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "user_memory_bytes"),
+			"GPU memory in bytes used by the processes of each user running on the GPU.",
+			withLabels("uid", "user"), nil,
+		),
+		gpuMaxCustomerBoostClockDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "max_customer_boost_clock_hertz"),
+			"Advertised maximum boost clock of the graphics domain in hertz, as opposed to the maximum clock the GPU supports.",
+			deviceLabels, nil,
+		),
+		gpuPowerLimitSourceDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "power_limit_source"),
+			"Source of the active power limit: 0=default, 1=user (enforced limit differs from the default), 2=brake (hardware power brake or thermal slowdown).",
+			deviceLabels, nil,
+		),
+		gpuUtilizationMinDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "utilisation_min_percentage"),
+			"Minimum GPU utilisation in percent over the internal sampler polls since the last scrape.",
+			deviceLabels, nil,
+		),
+		gpuUtilizationMaxDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "utilisation_max_percentage"),
+			"Maximum GPU utilisation in percent over the internal sampler polls since the last scrape.",
+			deviceLabels, nil,
+		),
+		gpuProcessCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "process_count"),
+			"Number of distinct processes with a compute or graphics context on the GPU.",
+			deviceLabels, nil,
+		),
+		gpuTimesliceReplicasDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "timeslice_replicas"),
+			"Number of replicas the Kubernetes device plugin advertises the GPU as when sharing it by time-slicing.",
+			deviceLabels, nil,
+		),
+		gpuVFCurveMinOffsetDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "vf_curve_min_offset_hertz"),
+			"Lowest offset that can be applied to the voltage/frequency curve of each clock in hertz. Mostly reported by GeForce and workstation GPUs, datacenter GPUs do not support clock offsets.",
+			withLabels("clock"), nil,
+		),
+		gpuVFCurveMaxOffsetDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "vf_curve_max_offset_hertz"),
+			"Highest offset that can be applied to the voltage/frequency curve of each clock in hertz. Mostly reported by GeForce and workstation GPUs, datacenter GPUs do not support clock offsets.",
+			withLabels("clock"), nil,
+		),
+		gpuFanSpeedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "fan_speed_percent"),
+			"Speed of each GPU fan in percent of its maximum speed.",
+			withLabels("fan"), nil,
+		),
+		gpuFanTargetSpeedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "fan_target_speed_percent"),
+			"Speed each GPU fan is commanded to in percent of its maximum speed. A lasting gap to node_gpu_fan_speed_percent indicates a failing fan.",
+			withLabels("fan"), nil,
+		),
+		gpuFanControlPolicyDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "fan_control_policy"),
+			"Control policy of each GPU fan: 0=temperature (driver controlled), 1=manual.",
+			withLabels("fan"), nil,
+		),
+		gpuNVMLErrorsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvml_errors_total"),
+			"Number of core NVML calls of each category that failed with an error other than not supported.",
+			[]string{"call"}, nil,
+		),
+		gpuMemoryThermalThrottleDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "memory_thermal_throttle"),
+			"Whether the memory clock is below its target during a thermal slowdown while the memory temperature is within 5 degrees of the memory maximum operating temperature.",
+			deviceLabels, nil,
+		),
+		gpuPeakFP32TFLOPSDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "peak_fp32_tflops"),
+			"Theoretical peak FP32 throughput in TFLOPS, estimated as CUDA cores x maximum SM clock x 2 (one fused multiply-add per core and clock). Real workloads reach less.",
+			deviceLabels, nil,
+		),
+		gpuGPMIntegerActivityDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "gpm_integer_activity_percent"),
+			"Percentage of time the integer (IMMA) tensor pipes were active between this scrape and the previous one, from GPM.",
+			deviceLabels, nil,
+		),
+		gpuIdlePowerWasteDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "idle_power_waste"),
+			"Whether the GPU is idle (at most 1% utilisation) but draws more power than --collector.nvidia.idle-power-threshold.",
+			deviceLabels, nil,
+		),
+		gpuECCDBEAggregateDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "ecc_dbe_aggregate_total"),
+			"Number of uncorrectable double bit ECC errors over the lifetime of the GPU.",
+			deviceLabels, nil,
+		),
+		gpuECCRMAThresholdExceededDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "ecc_rma_threshold_exceeded"),
+			"Whether the lifetime double bit ECC error count exceeds --collector.nvidia.ecc-rma-threshold.",
+			deviceLabels, nil,
+		),
+		gpuDriverNVMLCompatibleDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "driver_nvml_compatible"),
+			"Whether the NVML library belongs to the loaded driver (1) or not (0), i.e. whether the NVML version without its CUDA major version prefix equals the driver version.",
+			nil, nil,
+		),
+		devices:     make(map[string]*gpuDeviceState),
+		lastReturns: make(map[string]nvml.Return),
+		userNames:   make(map[string]string),
+		nvmlErrors:  make(map[string]uint64),
+		stop:        make(chan struct{}),
+		seen:        make(map[int]gpuSeenDevice),
+		groups: gpuMetricGroups{
+			powerSamples:          *gpuPowerSamples,
+			utilisationSamples:    *gpuUtilisationSamples,
+			processes:             *gpuProcesses,
+			p2p:                   *gpuP2P,
+			mps:                   *gpuMPS,
+			memoryTransferSamples: *gpuMemoryTransferSamples,
+		},
+	}
+
+	callDurationName := prometheus.BuildFQName(namespace, gpuCollectorSubsystem, "nvml_call_duration_seconds")
+	callDurationHelp := "Duration of NVML calls made while collecting GPU metrics, by category of call."
+	if *gpuCallDurationHistogram {
+		g.callDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    callDurationName,
+			Help:    callDurationHelp,
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"call"})
+	} else {
+		g.callDurations = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: callDurationName,
+			Help: callDurationHelp,
+		}, []string{"call"})
+	}
+
+	return g
+}
+
+// reloadOnSIGHUP re-reads the metric group flags every time the process receives SIGHUP, until
+// stop is closed
+func (g *gpuCollector) reloadOnSIGHUP(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		}
+
+		groups, err := parseGPUMetricGroups(os.Args[1:])
+		if err != nil {
+			g.logger.Error("failed to reload metric groups", "err", err)
+			continue
+		}
+		var config *gpuConfig
+		if *gpuConfigFile != "" {
+			if config, err = loadGPUConfig(*gpuConfigFile); err != nil {
+				g.logger.Error("failed to reload GPU config file", "path", *gpuConfigFile, "err", err)
+				continue
+			}
+		}
+		g.groupsMutex.Lock()
+		g.groups = groups
+		g.config = config
+		g.groupsMutex.Unlock()
+		g.logger.Info("reloaded metric groups", "power_samples", groups.powerSamples, "utilisation_samples", groups.utilisationSamples, "processes", groups.processes, "p2p", groups.p2p, "mps", groups.mps, "memory_transfer_samples", groups.memoryTransferSamples)
+	}
+}
+
+// startEvents registers every GPU for the handled NVML events and starts the goroutine
+// counting them. devices attached later are registered by updateTopology.
+func (g *gpuCollector) startEvents() error {
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("could not retrieve GPU count: %v", ret)
+	}
+	set, ret := nvml.EventSetCreate()
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("could not create event set: %v", ret)
+	}
+
+	events := make(map[string]*gpuEventCounts)
+	for i := 0; i < count; i++ {
+		device, ret := nvml.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			g.logger.Warn("failed to get handle for GPU device", "gpu_index", i, "return", ret)
+			continue
+		}
+		uuid, ret := device.GetUUID()
+		if ret != nvml.SUCCESS {
+			g.logger.Warn("failed to get GPU UUID", "gpu_index", i, "return", ret)
+			continue
+		}
+		if g.registerEvents(set, device, uuid) {
+			events[uuid] = &gpuEventCounts{}
+		}
+	}
+	if len(events) == 0 {
+		set.Free()
+		return errors.New("no GPU supports the watched events")
+	}
+
+	g.eventsMutex.Lock()
+	g.events = events
+	g.eventSet = set
+	g.eventsMutex.Unlock()
+
+	g.running.Add(1)
+	go func() {
+		defer g.running.Done()
+		g.watchEvents(set, g.stop)
+	}()
+	return nil
+}
+
+// registerEvents registers the watched events of device with set, returning whether any were registered
+func (g *gpuCollector) registerEvents(set nvml.EventSet, device nvml.Device, uuid string) bool {
+	supported, ret := device.GetSupportedEventTypes()
+	if ret != nvml.SUCCESS || supported&gpuEventTypes == 0 {
+		g.logger.Debug("GPU does not support the watched events", "uuid", uuid, "return", ret)
+		return false
+	}
+	if ret := device.RegisterEvents(supported&gpuEventTypes, set); ret != nvml.SUCCESS {
+		g.logger.Warn("failed to register GPU events", "uuid", uuid, "return", ret)
+		return false
+	}
+	return true
+}
+
+// watchEvents counts the events delivered to set until stop is closed, then frees the set.
+// stop is checked between waits, so it takes up to gpuEventWaitTimeout to take effect.
+func (g *gpuCollector) watchEvents(set nvml.EventSet, stop <-chan struct{}) {
+	defer func() {
+		g.eventsMutex.Lock()
+		g.eventSet = nil
+		g.eventsMutex.Unlock()
+		set.Free()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		data, ret := set.Wait(gpuEventWaitTimeout)
+		if ret == nvml.ERROR_TIMEOUT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to wait for GPU events", "return", ret)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(gpuEventWaitTimeout) * time.Millisecond):
+			}
+			continue
+		}
+		g.handleEvent(data)
+	}
+}
+
+// handleEvent updates the counters of the device an event was delivered for
+func (g *gpuCollector) handleEvent(data nvml.EventData) {
+	uuid, ret := data.Device.GetUUID()
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU UUID for event", "return", ret)
+		return
+	}
+
+	g.eventsMutex.Lock()
+	defer g.eventsMutex.Unlock()
+	counts := g.events[uuid]
+	if counts == nil {
+		return
+	}
+
+	switch data.EventType {
+	case nvml.EventTypeClock:
+		reasons, ret := data.Device.GetCurrentClocksEventReasons()
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU clock event reasons", "uuid", uuid, "return", ret)
+			return
+		}
+		slowdown := reasons&gpuThermalSlowdownReasons != 0
+		if slowdown && !counts.thermalSlowdown {
+			counts.thermalCrossings++
+		}
+		counts.thermalSlowdown = slowdown
+	case nvml.EventTypeSingleBitEccError:
+		counts.sbeEvents++
+	}
+}
+
+// Close stops the background goroutines of the collector and waits for them to return. the
+// Collector interface of node_exporter has no Close, so it is only called by code embedding the
+// collector directly.
+func (g *gpuCollector) Close() error {
+	g.stopOnce.Do(func() { close(g.stop) })
+	g.running.Wait()
+	return nil
+}
+
+// startSampler starts the internal sampler, polling at interval until Close is called
+func (g *gpuCollector) startSampler(interval time.Duration) {
+	g.sampler = newGPUSampler(g.logger, interval)
+	g.running.Add(1)
+	go func() {
+		defer g.running.Done()
+		g.sampler.run(g.stop)
+	}()
+}
+
+// gpuSampleWindow is the minimum, maximum and sum of the values polled since the last scrape
+type gpuSampleWindow struct {
+	min, max, sum float64
+	count         int
+}
+
+func (w *gpuSampleWindow) add(value float64) {
+	if w.count == 0 || value < w.min {
+		w.min = value
+	}
+	if w.count == 0 || value > w.max {
+		w.max = value
+	}
+	w.sum += value
+	w.count++
+}
+
+// gpuSamplerWindows are the windows the internal sampler keeps per GPU
+type gpuSamplerWindows struct {
+	// watts
+	power gpuSampleWindow
+	// percent
+	utilisation gpuSampleWindow
+}
+
+// gpuSampler polls the power and utilisation of every GPU in the background at a fixed interval,
+// so transients shorter than the scrape interval show up in the minimum and maximum of the next scrape
+type gpuSampler struct {
+	logger   *slog.Logger
+	interval time.Duration
+
+	mutex sync.Mutex
+	// windows since the last scrape keyed by UUID
+	windows map[string]*gpuSamplerWindows
+}
+
+func newGPUSampler(logger *slog.Logger, interval time.Duration) *gpuSampler {
+	return &gpuSampler{
+		logger:   logger,
+		interval: interval,
+		windows:  make(map[string]*gpuSamplerWindows),
+	}
+}
+
+// run polls the GPUs until stop is closed
+func (s *gpuSampler) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+// sample polls the power and utilisation of every GPU once
+func (s *gpuSampler) sample() {
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		s.logger.Debug("failed to get GPU count for sampling", "return", ret)
+		return
+	}
+	for i := 0; i < count; i++ {
+		device, ret := nvml.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		uuid, ret := device.GetUUID()
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		// NVML reports power in milliwatts
+		power, powerRet := device.GetPowerUsage()
+		utilisation, utilisationRet := device.GetUtilizationRates()
+
+		s.mutex.Lock()
+		windows := s.windows[uuid]
+		if windows == nil {
+			windows = &gpuSamplerWindows{}
+			s.windows[uuid] = windows
+		}
+		if powerRet == nvml.SUCCESS {
+			windows.power.add(float64(power) / 1000)
+		}
+		if utilisationRet == nvml.SUCCESS && utilisation.Gpu <= gpuMaxValidUtilisation {
+			windows.utilisation.add(float64(utilisation.Gpu))
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// take returns the windows of the GPU with the given UUID and starts new ones for the next scrape
+func (s *gpuSampler) take(uuid string) gpuSamplerWindows {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	windows := s.windows[uuid]
+	if windows == nil {
+		return gpuSamplerWindows{}
+	}
+	delete(s.windows, uuid)
+	return *windows
+}
+
+// metricGroups returns the currently enabled metric groups and the per-GPU overrides
+func (g *gpuCollector) metricGroups() (gpuMetricGroups, *gpuConfig) {
+	g.groupsMutex.Lock()
+	defer g.groupsMutex.Unlock()
+	return g.groups, g.config
+}
+
+// gpuConfig is the content of --collector.nvidia.config-file, e.g.
+//
+//	gpus:
+//	  - name: "NVIDIA H100.*"
+//	    groups:
+//	      processes: false
+//	  - uuid: GPU-5c8a3e7e-7b1c-4f3d-9a6e-2b9d1c0e4f11
+//	    groups:
+//	      processes: true
+//	      power-samples: true
+//
+// every rule matching a GPU is applied in order, so later rules override earlier ones
+type gpuConfig struct {
+	GPUs []gpuConfigRule `yaml:"gpus"`
+}
+
+// gpuConfigRule selects metric groups for the GPUs with the given UUID or a name matching the regex
+type gpuConfigRule struct {
+	UUID   string          `yaml:"uuid"`
+	Name   string          `yaml:"name"`
+	Groups map[string]bool `yaml:"groups"`
+
+	name *regexp.Regexp
+}
+
+// loadGPUConfig reads and validates the config file at path. group names are the metric group
+// flags without the collector.nvidia. prefix. p2p covers pairs of GPUs and can only be set by its flag.
+func loadGPUConfig(path string) (*gpuConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config gpuConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+
+	for i := range config.GPUs {
+		rule := &config.GPUs[i]
+		if (rule.UUID == "") == (rule.Name == "") {
+			return nil, fmt.Errorf("rule %d: exactly one of uuid and name must be set", i)
+		}
+		if rule.Name != "" {
+			if rule.name, err = regexp.Compile("^(?:" + rule.Name + ")$"); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid name regex: %w", i, err)
+			}
+		}
+		for group := range rule.Groups {
+			if _, ok := gpuMetricGroupFlags["collector.nvidia."+group]; !ok || group == "p2p" {
+				return nil, fmt.Errorf("rule %d: unknown metric group %q", i, group)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// deviceGroups returns groups with the overrides of every rule matching the GPU applied.
+// a nil config leaves groups unchanged.
+func (c *gpuConfig) deviceGroups(groups gpuMetricGroups, uuid, name string) gpuMetricGroups {
+	if c == nil {
+		return groups
+	}
+	for _, rule := range c.GPUs {
+		if (rule.UUID != "" && rule.UUID != uuid) || (rule.name != nil && !rule.name.MatchString(name)) {
+			continue
+		}
+		for group, enabled := range rule.Groups {
+			*gpuMetricGroupFlags["collector.nvidia."+group](&groups) = enabled
+		}
+	}
+	return groups
+}
+
+// labels that can be attached to per-device metrics, in the order they are attached
+var gpuSupportedLabels = []string{"gpu_index", "gpu_name", "uuid", "pci_bus_id"}
+
+// parseGPULabels parses the comma-separated --collector.nvidia.labels allowlist, adding
+// pci_bus_id when --collector.nvidia.label-pci-bus-id is set
+func parseGPULabels(value string, pciBusID bool) ([]string, error) {
+	requested := make(map[string]bool)
+	for _, label := range strings.Split(value, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		if !slices.Contains(gpuSupportedLabels, label) {
+			return nil, fmt.Errorf("unknown label %q, supported labels are %s", label, strings.Join(gpuSupportedLabels, ", "))
+		}
+		requested[label] = true
+	}
+	if pciBusID {
+		requested["pci_bus_id"] = true
+	}
+	// without an identifying label the series of different GPUs would collide
+	if !requested["gpu_index"] && !requested["uuid"] {
+		return nil, errors.New("labels must include gpu_index or uuid")
+	}
+
+	var labels []string
+	for _, label := range gpuSupportedLabels {
+		if requested[label] {
+			labels = append(labels, label)
+		}
+	}
+	return labels, nil
+}
+
+// gpuArgsFromFile returns whether any of the command line arguments is an @file argument
+func gpuArgsFromFile(args []string) bool {
+	return slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, "@") })
+}
+
+// parseGPUMetricGroups parses the metric group flags out of the command line arguments,
+// ignoring all other flags. @file arguments are expanded again, so the groups can be
+// changed without a restart by keeping the flags in a file and sending SIGHUP.
+func parseGPUMetricGroups(args []string) (gpuMetricGroups, error) {
+	var expanded []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			fileArgs, err := kingpin.ExpandArgsFromFile(arg[1:])
+			if err != nil {
+				return gpuMetricGroups{}, err
+			}
+			expanded = append(expanded, fileArgs...)
+			continue
+		}
+		expanded = append(expanded, arg)
+	}
+
+	var groups gpuMetricGroups
+	app := kingpin.New("node_exporter", "")
+	for name, field := range gpuMetricGroupFlags {
+		app.Flag(name, "").BoolVar(field(&groups))
+	}
+
+	var groupArgs []string
+	for _, arg := range expanded {
+		name, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "--"), "no-"), "=")
+		if _, ok := gpuMetricGroupFlags[name]; ok && strings.HasPrefix(arg, "--") {
+			groupArgs = append(groupArgs, arg)
+		}
+	}
+	if _, err := app.Parse(groupArgs); err != nil {
+		return gpuMetricGroups{}, err
+	}
+	return groups, nil
+}
+
+// Describe implements the prometheus.Collector interface
+func (g *gpuCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.gpuUtilizationDesc
+	ch <- g.gpuUtilizationAvgDesc
+	ch <- g.gpuTemperatureDesc
+	ch <- g.gpuMemoryTotalDesc
+	ch <- g.gpuMemoryUsedDesc
+	ch <- g.gpuMemoryFreeDesc
+	ch <- g.gpuMemoryRatioDesc
+	ch <- g.gpuInfoDesc
+	ch <- g.gpuPowerAvgDesc
+	ch <- g.gpuPowerMinDesc
+	ch <- g.gpuPowerMaxDesc
+	ch <- g.gpuThermalSensorTemperatureDesc
+	ch <- g.gpuCountDesc
+	ch <- g.gpuModelCountDesc
+	ch <- g.gpuMissingDesc
+	ch <- g.gpuClocksLockedDesc
+	ch <- g.gpuP2PStatusDesc
+	ch <- g.gpuFabricStateDesc
+	ch <- g.gpuFabricStatusDesc
+	ch <- g.gpuLostDesc
+	ch <- g.gpuTemperatureMaxOperatingDesc
+	ch <- g.gpuSRAMECCThresholdExceededDesc
+	ch <- g.gpuSRAMECCErrorsDesc
+	ch <- g.gpuEnergyCounterResetsDesc
+	ch <- g.gpuProcessMemoryUsedDesc
+	ch <- g.gpuThrottleSecondsDesc
+	ch <- g.gpuAPIRestrictionDesc
+	ch <- g.gpuPowerSourceDesc
+	ch <- g.gpuDRAMBandwidthDesc
+	ch <- g.gpuExclusiveModeOccupiedDesc
+	ch <- g.gpuPowerRailDesc
+	ch <- g.gpuIndexUUIDMapDesc
+	ch <- g.gpuGPCClockOffsetDesc
+	ch <- g.gpuMemClockOffsetDesc
+	ch <- g.gpuEncoderSessionsDesc
+	ch <- g.gpuBusySecondsDesc
+	ch <- g.gpuMemoryReservedDesc
+	ch <- g.gpuECCConfigConsistentDesc
+	ch <- g.gpuTopProcessMemoryDesc
+	ch <- g.gpuOtherProcessMemoryDesc
+	ch <- g.gpuThermalThresholdCrossingsDesc
+	ch <- g.gpuECCSBEEventsDesc
+	ch <- g.gpuNvLinkUtilisationDesc
+	ch <- g.gpuNvLinkLinksDesc
+	ch <- g.gpuNvLinkDownDesc
+	ch <- g.gpuPowerManagementDesc
+	ch <- g.gpuThrottleRatioDesc
+	ch <- g.gpuMemoryConventionDesc
+	ch <- g.gpuCollectorPanicsDesc
+	ch <- g.gpuPowerLimitChangesDesc
+	ch <- g.gpuMPSActiveDesc
+	ch <- g.gpuPCIeAERErrorsDesc
+	ch <- g.gpuContextCountDesc
+	ch <- g.gpuWarmupDesc
+	ch <- g.gpuScrapeSuccessDesc
+	ch <- g.gpuResetsDesc
+	ch <- g.gpuECCSBEVolatileDesc
+	ch <- g.gpuPrimaryThrottleReasonDesc
+	ch <- g.gpuTopologyChangesDesc
+	ch <- g.gpuPCIeUtilisationDesc
+	ch <- g.gpuBoardPowerLimitDesc
+	ch <- g.gpuBoardPowerLimitRatioDesc
+	ch <- g.gpuDomainUtilisationDesc
+	ch <- g.gpuMemoryTemperatureDesc
+	ch <- g.gpuMemoryTemperatureThrottlingDesc
+	ch <- g.gpuNVMLLastReturnDesc
+	ch <- g.gpuNvLinkStateBitmaskDesc
+	ch <- g.gpuCPUAffinityDesc
+	ch <- g.gpuPersistenceModeDesc
+	ch <- g.gpuPersistenceModeMismatchDesc
+	ch <- g.gpuClockEventReasonScrapesDesc
+	ch <- g.gpuPowerDesc
+	ch <- g.gpuPowerAverageDesc
+	ch <- g.gpuVideoClockDesc
+	ch <- g.gpuVideoClockRatioDesc
+	ch <- gpuNVMLInitSuccessDesc
+	ch <- g.gpuMemoryTransferredDesc
+	ch <- g.gpuECCRebootRequiredDesc
+	ch <- g.gpuUserMemoryDesc
+	ch <- g.gpuMaxCustomerBoostClockDesc
+	ch <- g.gpuPowerLimitSourceDesc
+	ch <- g.gpuUtilizationMinDesc
+	ch <- g.gpuUtilizationMaxDesc
+	ch <- g.gpuProcessCountDesc
+	ch <- g.gpuTimesliceReplicasDesc
+	ch <- g.gpuVFCurveMinOffsetDesc
+	ch <- g.gpuVFCurveMaxOffsetDesc
+	ch <- g.gpuFanSpeedDesc
+	ch <- g.gpuFanTargetSpeedDesc
+	ch <- g.gpuFanControlPolicyDesc
+	ch <- g.gpuNVMLErrorsDesc
+	ch <- g.gpuMemoryThermalThrottleDesc
+	ch <- g.gpuPeakFP32TFLOPSDesc
+	ch <- g.gpuGPMIntegerActivityDesc
+	ch <- g.gpuIdlePowerWasteDesc
+	ch <- g.gpuECCDBEAggregateDesc
+	ch <- g.gpuECCRMAThresholdExceededDesc
+	ch <- g.gpuDriverNVMLCompatibleDesc
+	g.callDurations.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface
+func (g *gpuCollector) Collect(ch chan<- prometheus.Metric) {
+	_ = g.Update(ch)
+}
+
+// observeCall records how long a category of NVML calls took since start
+func (g *gpuCollector) observeCall(call string, start time.Time) {
+	g.callDurations.WithLabelValues(call).Observe(time.Since(start).Seconds())
+}
+
+// observeReturn records how long an NVML call of the core readings took and what it returned
+func (g *gpuCollector) observeReturn(call string, start time.Time, ret nvml.Return) {
+	g.observeCall(call, start)
+	g.lastReturns[call] = ret
+	// unsupported readings are expected on many GPUs and are not errors
+	if ret != nvml.SUCCESS && ret != nvml.ERROR_NOT_SUPPORTED {
+		g.scrapeErrors++
+		if *gpuErrorPolicy != "ignore" {
+			g.nvmlErrors[call]++
+		}
+	}
+}
+
+// collectReturns exports the return code of the most recent core NVML call of each category
+func (g *gpuCollector) collectReturns(ch chan<- prometheus.Metric) {
+	for call, ret := range g.lastReturns {
+		ch <- prometheus.MustNewConstMetric(g.gpuNVMLLastReturnDesc, prometheus.GaugeValue, float64(ret), call)
+	}
+}
+
+// collectErrors exports the number of failed core NVML calls of each category, unless errors are ignored
+func (g *gpuCollector) collectErrors(ch chan<- prometheus.Metric) {
+	if *gpuErrorPolicy == "ignore" {
+		return
+	}
+	for call, n := range g.nvmlErrors {
+		ch <- prometheus.MustNewConstMetric(g.gpuNVMLErrorsDesc, prometheus.CounterValue, float64(n), call)
+	}
+}
+
+// recoverDevicePanic recovers from a panic while collecting the device at index, so the
+// metrics of the other devices are still collected
+func (g *gpuCollector) recoverDevicePanic(index int) {
+	if r := recover(); r != nil {
+		g.panics++
+		g.logger.Error("recovered from panic while collecting GPU metrics", "gpu_index", index, "panic", r, "stack", string(debug.Stack()))
+	}
+}
+
+// stableIndex returns the persisted gpu_index of uuid, saving the state when a new GPU is assigned one
+func (g *gpuCollector) stableIndex(uuid string) int {
+	index, assigned := g.indexState.index(uuid)
+	if assigned {
+		g.logger.Info("assigned GPU index", "uuid", uuid, "gpu_index", index)
+		if err := g.indexState.save(); err != nil {
+			g.logger.Warn("failed to save GPU index state", "path", g.indexState.path, "err", err)
+		}
+	}
+	return index
+}
+
+// updateScrapeSuccess records the outcome of this scrape of the device and exports the
+// success ratio over the recent scrapes
+func (g *gpuCollector) updateScrapeSuccess(ch chan<- prometheus.Metric, state *gpuDeviceState, labels []string, scraped bool) {
+	window := max(*gpuScrapeSuccessWindow, 1)
+	if len(state.scrapeResults) < window {
+		state.scrapeResults = append(state.scrapeResults, scraped)
+	} else {
+		state.scrapeResults[state.scrapeNext] = scraped
+		state.scrapeNext = (state.scrapeNext + 1) % window
+	}
+
+	successes := 0
+	for _, result := range state.scrapeResults {
+		if result {
+			successes++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuScrapeSuccessDesc, prometheus.GaugeValue, float64(successes)/float64(len(state.scrapeResults)), labels...)
+}
+
+// updateScrapeFailure records a failed scrape of the GPU at NVML index i, whose handle or UUID
+// could not be read, against the GPU last seen at the index. it reports false if no GPU was
+// seen there yet. callers must hold devicesMutex.
+func (g *gpuCollector) updateScrapeFailure(ch chan<- prometheus.Metric, i int) bool {
+	seen, ok := g.seen[i]
+	if !ok || seen.labels == nil {
+		return false
+	}
+	g.updateScrapeSuccess(ch, g.deviceState(seen.uuid, seen.gpuIndex), seen.labels, false)
+	return true
+}
+
+// updateCount exports the number of GPUs reported and, with --collector.nvidia.expected-count,
+// how many of the expected ones are missing
+func (g *gpuCollector) updateCount(ch chan<- prometheus.Metric, count int) {
+	if *gpuExpectedCount > 0 {
+		ch <- prometheus.MustNewConstMetric(g.gpuMissingDesc, prometheus.GaugeValue, float64(max(*gpuExpectedCount-count, 0)))
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuCountDesc, prometheus.GaugeValue, float64(count))
+}
+
+// deviceCount returns the number of GPUs, retrying while the driver is still
+// enumerating devices, e.g. shortly after boot
+func (g *gpuCollector) deviceCount() (int, nvml.Return) {
+	count, ret := nvml.DeviceGetCount()
+	for attempt := 1; attempt < gpuDeviceCountAttempts && gpuDeviceCountTransient(ret); attempt++ {
+		g.logger.Debug("GPU count not available yet, retrying", "attempt", attempt, "return", ret)
+		time.Sleep(gpuDeviceCountRetryInterval)
+		count, ret = nvml.DeviceGetCount()
+	}
+	return count, ret
+}
+
+// gpuDeviceCountTransient returns whether a DeviceGetCount failure may clear up on its own
+func gpuDeviceCountTransient(ret nvml.Return) bool {
+	switch ret {
+	case nvml.ERROR_DRIVER_NOT_LOADED, nvml.ERROR_UNINITIALIZED, nvml.ERROR_TIMEOUT, nvml.ERROR_IN_USE:
+		return true
+	}
+	return false
+}
+
+// update collects GPU metrics using NVML and sends them to the prometheus metric channel
+func (g *gpuCollector) Update(ch chan<- prometheus.Metric) error {
+	// the per-device state is updated while collecting, so serialise scrapes
+	g.devicesMutex.Lock()
+	defer g.devicesMutex.Unlock()
+
+	groups, config := g.metricGroups()
+	defer g.callDurations.Collect(ch)
+	defer g.collectReturns(ch)
+	defer g.collectErrors(ch)
+	g.scrapeErrors = 0
+	ch <- prometheus.MustNewConstMetric(gpuNVMLInitSuccessDesc, prometheus.GaugeValue, 1)
+
+	// retrieve the number of NVIDIA GPUs
+	start := time.Now()
+	count, ret := g.deviceCount()
+	g.observeReturn("device_count", start, ret)
+	if ret != nvml.SUCCESS {
+		g.logger.Error("failed to get GPU count", "return", ret)
+		return fmt.Errorf("could not retrieve GPU count: %v", ret)
+	}
+	if count == 0 {
+		g.updateCount(ch, 0)
+		return errors.New("no NVIDIA GPUs found")
+	}
+
+	convention := "include_reserved"
+	if !*gpuMemoryIncludeReserved {
+		convention = "exclude_reserved"
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuMemoryConventionDesc, prometheus.GaugeValue, 1, convention)
+	g.updateDriverNVMLCompatible(ch)
+
+	// the feature file is read once per scrape, the device plugin applies the replicas to every GPU
+	replicas := 0
+	if *gpuTimesliceLabelsFile != "" {
+		var err error
+		if replicas, err = gpuTimesliceReplicas(*gpuTimesliceLabelsFile); err != nil {
+			g.logger.Debug("failed to read GPU time-slicing replicas", "path", *gpuTimesliceLabelsFile, "err", err)
+		}
+	}
+
+	// number of GPUs per model, exported once all devices have been enumerated
+	modelCounts := make(map[string]int)
+	// devices that were collected, for metrics relating pairs of GPUs
+	var devices []*gpuDevice
+	// indexes of the devices NVML reported as lost during this scrape
+	lost := make(map[int]bool)
+	// current ECC modes of the devices that support ECC
+	var eccModes []nvml.EnableState
+	// handles of the devices whose UUID could be read, keyed by UUID
+	present := make(map[string]nvml.Device)
+	// indexes of the devices left out because the cgroup of --collector.nvidia.cgroup may not access them,
+	// or they could not be identified as ones it may access
+	hidden := make(map[int]bool)
+	unidentified := false
+
+	// without a readable device list every GPU would be reported, so the scrape fails instead
+	var cgroupDevices *gpuCgroupDevices
+	if *gpuCgroup != "" {
+		var err error
+		if cgroupDevices, err = readGPUCgroupDevices(*gpuCgroup); err != nil {
+			return fmt.Errorf("could not read the devices of cgroup %s: %w", *gpuCgroup, err)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		// a panic in NVML or in unpacking its results only loses the rest of this device
+		func() {
+			defer g.recoverDevicePanic(i)
+
+			start = time.Now()
+			device, ret := nvml.DeviceGetHandleByIndex(i)
+			g.observeReturn("handle", start, ret)
+			if ret != nvml.SUCCESS {
+				g.logger.Warn("failed to get handle for GPU device", "gpu_index", i, "return", ret)
+				// the GPU may be a neighbour's, so it is only reported if the cgroup's GPU was seen at the index
+				if cgroupDevices != nil && g.seen[i].uuid == "" {
+					hidden[i] = true
+					unidentified = true
+					return
+				}
+				lost[i] = ret == nvml.ERROR_GPU_IS_LOST
+				g.updateScrapeFailure(ch, i)
+				return
+			}
+
+			// /dev/nvidia<minor> is the device node the cgroup has to allow
+			if cgroupDevices != nil {
+				minor, ret := device.GetMinorNumber()
+				if ret != nvml.SUCCESS || !cgroupDevices.allows(minor) {
+					if ret != nvml.SUCCESS {
+						g.logger.Debug("failed to get GPU minor number, leaving the GPU out", "gpu_index", i, "return", ret)
+						unidentified = true
+					}
+					hidden[i] = true
+					return
+				}
+			}
+
+			// retrieve the GPU name
+			start = time.Now()
+			name, ret := device.GetName()
+			g.observeReturn("name", start, ret)
+			if ret != nvml.SUCCESS {
+				g.logger.Warn("failed to get GPU name", "gpu_index", i, "return", ret)
+				name = "unknown"
+			}
+			modelCounts[name]++
+
+			// retrieve the GPU UUID, used to key the per-device state
+			start = time.Now()
+			uuid, ret := device.GetUUID()
+			g.observeReturn("uuid", start, ret)
+			if ret != nvml.SUCCESS {
+				g.logger.Warn("failed to get GPU UUID", "gpu_index", i, "return", ret)
+				// without gpu_index the series of GPUs whose UUID cannot be read would collide
+				if !slices.Contains(g.deviceLabels, "gpu_index") {
+					g.updateScrapeFailure(ch, i)
+					return
+				}
+				uuid = ""
+			} else {
+				present[uuid] = device
+			}
+
+			// metric groups for this GPU, after the overrides of the config file
+			deviceGroups := config.deviceGroups(groups, uuid, name)
+
+			gpuIndex := strconv.Itoa(i)
+			if g.indexState != nil && uuid != "" {
+				gpuIndex = strconv.Itoa(g.stableIndex(uuid))
+			}
+			// retrieve the PCI bus id
+			pciBusID := ""
+			start = time.Now()
+			pciInfo, ret := device.GetPciInfo()
+			g.observeReturn("pci_info", start, ret)
+			if ret == nvml.SUCCESS {
+				pciBusID = int8ToString(pciInfo.BusId[:])
+			} else {
+				g.logger.Warn("failed to get GPU PCI info", "gpu_index", i, "return", ret)
+			}
+
+			dev := &gpuDevice{
+				Device:   device,
+				index:    i,
+				gpuIndex: gpuIndex,
+				uuid:     uuid,
+				pciBusID: pciBusID,
+				state:    g.deviceState(uuid, gpuIndex),
+			}
+			labelValues := map[string]string{"gpu_index": gpuIndex, "gpu_name": name, "uuid": uuid, "pci_bus_id": pciBusID}
+			for _, label := range g.deviceLabels {
+				dev.labels = append(dev.labels, labelValues[label])
+			}
+			if uuid != "" {
+				g.seen[i] = gpuSeenDevice{uuid: uuid, gpuIndex: gpuIndex, labels: dev.labels}
+			}
+
+			// the scrape of the device succeeds when its core readings can be taken. without
+			// a UUID it fails, and is recorded against the GPU last seen at the index if any
+			scraped := false
+			defer func() {
+				if uuid == "" && g.updateScrapeFailure(ch, i) {
+					return
+				}
+				g.updateScrapeSuccess(ch, dev.state, dev.labels, scraped && uuid != "")
+			}()
+
+			// retrieve GPU utilization rates
+			start = time.Now()
+			util, ret := device.GetUtilizationRates()
+			g.observeReturn("utilisation", start, ret)
+			if ret != nvml.SUCCESS {
+				g.logger.Warn("failed to get GPU utilization", "gpu_index", i, "return", ret)
+				lost[i] = ret == nvml.ERROR_GPU_IS_LOST
+				return
+			}
+
+			// retrieve GPU temperature
+			start = time.Now()
+			temp, ret := device.GetTemperature(nvml.TEMPERATURE_GPU)
+			g.observeReturn("temperature", start, ret)
+			if ret != nvml.SUCCESS {
+				g.logger.Warn("failed to get GPU temperature", "gpu_index", i, "return", ret)
+				lost[i] = ret == nvml.ERROR_GPU_IS_LOST
+				return
+			}
+
+			// retrieve GPU memory info
+			start = time.Now()
+			mem, ret := device.GetMemoryInfo()
+			g.observeReturn("memory", start, ret)
+			if ret != nvml.SUCCESS {
+				g.logger.Warn("failed to get GPU memory info", "gpu_index", i, "return", ret)
+				lost[i] = ret == nvml.ERROR_GPU_IS_LOST
+				return
+			}
+
+			scraped = true
+			devices = append(devices, dev)
+
+			gpuUtilization := float64(util.Gpu)
+			utilisationExported := false
+
+			// export metrics, skipping readings that are out of range. the first utilisation
+			// reading after initialisation can be stale, so it is only used to warm up
+			if g.validReading(dev, "utilisation", gpuUtilization, 0, gpuMaxValidUtilisation) {
+				if dev.state.utilisationWarm {
+					utilisationExported = true
+					ch <- prometheus.MustNewConstMetric(
+						g.gpuUtilizationDesc,
+						prometheus.GaugeValue,
+						gpuUtilization,
+						dev.labels...,
+					)
+				}
+				ch <- prometheus.MustNewConstMetric(g.gpuWarmupDesc, prometheus.GaugeValue, boolToFloat64(!dev.state.utilisationWarm), dev.labels...)
+				dev.state.utilisationWarm = true
+			}
+			if g.validReading(dev, "temperature", float64(temp), 0, gpuMaxValidTemperature) {
+				ch <- prometheus.MustNewConstMetric(
+					g.gpuTemperatureDesc,
+					prometheus.GaugeValue,
+					float64(temp),
+					dev.labels...,
+				)
+			}
+			reserved, reservedOK := g.reservedMemory(dev)
+			if reservedOK {
+				ch <- prometheus.MustNewConstMetric(g.gpuMemoryReservedDesc, prometheus.GaugeValue, float64(reserved), dev.labels...)
+				if !*gpuMemoryIncludeReserved && reserved <= mem.Used {
+					mem.Used -= reserved
+				}
+			}
+			if g.validReading(dev, "memory_total", float64(mem.Total), 1, gpuMaxValidMemoryBytes) &&
+				g.validReading(dev, "memory_used", float64(mem.Used), 0, float64(mem.Total)) {
+				ch <- prometheus.MustNewConstMetric(
+					g.gpuMemoryTotalDesc,
+					prometheus.GaugeValue,
+					float64(mem.Total),
+					dev.labels...,
+				)
+				ch <- prometheus.MustNewConstMetric(
+					g.gpuMemoryUsedDesc,
+					prometheus.GaugeValue,
+					float64(mem.Used),
+					dev.labels...,
+				)
+				ch <- prometheus.MustNewConstMetric(
+					g.gpuMemoryFreeDesc,
+					prometheus.GaugeValue,
+					float64(mem.Free),
+					dev.labels...,
+				)
+				ch <- prometheus.MustNewConstMetric(
+					g.gpuMemoryRatioDesc,
+					prometheus.GaugeValue,
+					float64(mem.Used)/float64(mem.Total),
+					dev.labels...,
+				)
+			}
+			// export a static metric with GPU information
+			info := g.staticInfo(dev)
+			ch <- prometheus.MustNewConstMetric(
+				g.gpuInfoDesc,
+				prometheus.GaugeValue,
+				1,
+				gpuIndex, name, uuid, pciBusID, info.serial, info.vbiosVersion, info.driverVersion, info.driverBranch, info.driverType, info.computeCapability, info.architecture, info.brand,
+			)
+			if uuid != "" {
+				ch <- prometheus.MustNewConstMetric(g.gpuIndexUUIDMapDesc, prometheus.GaugeValue, 1, gpuIndex, uuid)
+			}
+			if info.cpuAffinity != "" {
+				ch <- prometheus.MustNewConstMetric(g.gpuCPUAffinityDesc, prometheus.GaugeValue, 1, dev.labelsWith(info.cpuAffinity)...)
+			}
+
+			if watts, ok := g.updatePower(ch, dev); ok && utilisationExported {
+				g.updateIdlePowerWaste(ch, dev, util.Gpu, watts)
+			}
+			// the internal sampler replaces the NVML sample buffers as the source of the avg/min/max metrics
+			if g.sampler != nil {
+				g.updateSamplerWindows(ch, dev)
+			} else {
+				if deviceGroups.powerSamples {
+					g.updatePowerSamples(ch, dev)
+				}
+				if deviceGroups.utilisationSamples {
+					g.updateUtilisationSamples(ch, dev)
+				}
+			}
+			if deviceGroups.memoryTransferSamples {
+				g.updateMemoryTransferred(ch, dev)
+			}
+
+			g.updateThermalSensors(ch, dev)
+			g.updateMaxOperatingTemperatures(ch, dev)
+			memoryTemp, memoryTempOK := g.updateMemoryTemperature(ch, dev)
+			g.updateFans(ch, dev)
+			g.updateFabricInfo(ch, dev)
+			g.updateSRAMECC(ch, dev)
+			g.updateVolatileECC(ch, dev)
+			g.updateAggregateECC(ch, dev)
+			g.updateEnergyCounterResets(ch, dev)
+			g.updateViolations(ch, dev)
+			g.updateAPIRestrictions(ch, dev)
+			g.updatePowerSource(ch, dev)
+			g.updateDRAMBandwidth(ch, dev, util.Memory)
+			g.updateExclusiveModeOccupied(ch, dev)
+			g.updatePowerRails(ch, dev)
+			g.updateClockOffsets(ch, dev)
+			g.updateClockOffsetBounds(ch, dev)
+			g.updateVideoClock(ch, dev)
+			g.updateMaxCustomerBoostClock(ch, dev)
+			g.updatePeakFP32(ch, dev)
+			g.updateEncoderSessions(ch, dev)
+			g.updateBusyTime(ch, dev, util.Gpu)
+			if mode, ok := g.updateECCMode(ch, dev); ok {
+				eccModes = append(eccModes, mode)
+			}
+			g.updateEventCounts(ch, dev)
+			g.updateNvLinks(ch, dev)
+			g.updatePowerManagement(ch, dev)
+			g.updatePersistenceMode(ch, dev)
+			powerLimit, powerLimitOK := g.updatePowerLimitChanges(ch, dev)
+			g.updateBoardPowerLimit(ch, dev, powerLimit, powerLimitOK)
+			g.updatePCIeAER(ch, dev)
+			g.updatePCIeUtilisation(ch, dev)
+
+			if replicas > 0 {
+				ch <- prometheus.MustNewConstMetric(g.gpuTimesliceReplicasDesc, prometheus.GaugeValue, float64(replicas), dev.labels...)
+			}
+
+			// processes are read once for the per-process, top consumer and MPS metrics
+			if deviceGroups.processes || deviceGroups.mps || *gpuTopProcesses > 0 {
+				processes := g.runningProcesses(dev)
+				if deviceGroups.processes {
+					g.updateContextCounts(ch, dev, processes)
+					g.updateProcesses(ch, dev, processes)
+					g.updateUserMemory(ch, dev, processes)
+				}
+				if *gpuTopProcesses > 0 {
+					g.updateTopProcesses(ch, dev, processes)
+				}
+				if deviceGroups.mps {
+					g.updateMPS(ch, dev, processes)
+				}
+			}
+
+			// retrieve the reasons the clocks are currently held below their maximum
+			start = time.Now()
+			reasons, ret := device.GetCurrentClocksEventReasons()
+			g.observeReturn("clock_event_reasons", start, ret)
+			if ret == nvml.SUCCESS {
+				ch <- prometheus.MustNewConstMetric(g.gpuClocksLockedDesc, prometheus.GaugeValue, boolToFloat64(g.clocksLocked(dev, reasons)), dev.labels...)
+				ch <- prometheus.MustNewConstMetric(g.gpuPrimaryThrottleReasonDesc, prometheus.GaugeValue, float64(gpuPrimaryThrottleReason(reasons)), dev.labels...)
+				g.updateClockEventReasonCounts(ch, dev, reasons)
+				if powerLimitOK {
+					g.updatePowerLimitSource(ch, dev, powerLimit, reasons)
+				}
+				if memoryTempOK {
+					g.updateMemoryThermalThrottle(ch, dev, memoryTemp, reasons)
+				}
+			} else if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU clock event reasons", "gpu_index", i, "return", ret)
+			}
+		}()
+	}
+
+	ch <- prometheus.MustNewConstMetric(g.gpuCollectorPanicsDesc, prometheus.CounterValue, float64(g.panics))
+
+	// only a scrape that identified every GPU can tell a removed GPU from a failed read
+	if !unidentified && len(present)+len(hidden) == count {
+		g.updateTopology(present, count)
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuTopologyChangesDesc, prometheus.CounterValue, float64(g.topologyChanges))
+
+	// like the model counts, the GPU count leaves out the GPUs the cgroup may not access
+	g.updateCount(ch, count-len(hidden))
+	for model, n := range modelCounts {
+		ch <- prometheus.MustNewConstMetric(g.gpuModelCountDesc, prometheus.GaugeValue, float64(n), model)
+	}
+
+	if groups.p2p {
+		g.updateP2PStatus(ch, devices)
+	}
+
+	if len(eccModes) > 0 {
+		consistent := true
+		for _, mode := range eccModes[1:] {
+			consistent = consistent && mode == eccModes[0]
+		}
+		ch <- prometheus.MustNewConstMetric(g.gpuECCConfigConsistentDesc, prometheus.GaugeValue, boolToFloat64(consistent))
+	}
+
+	// report every GPU seen so far, including ones no longer enumerated, so a lost
+	// device keeps its series instead of silently disappearing
+	for i := 0; i < count; i++ {
+		if _, ok := g.seen[i]; !ok && !hidden[i] {
+			g.seen[i] = gpuSeenDevice{gpuIndex: strconv.Itoa(i)}
+		}
+	}
+	for i, seen := range g.seen {
+		if hidden[i] {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(g.gpuLostDesc, prometheus.GaugeValue, boolToFloat64(lost[i] || i >= count), seen.gpuIndex, seen.uuid)
+	}
+
+	// the metrics of the scrape are still exported, but the collector is reported as failed
+	if *gpuErrorPolicy == "fail" && g.scrapeErrors > 0 {
+		return fmt.Errorf("%d NVML calls failed", g.scrapeErrors)
+	}
+	return nil
+}
+
+// validReading reports whether a value read from NVML is within [min, max], logging it otherwise
+func (g *gpuCollector) validReading(dev *gpuDevice, reading string, value, min, max float64) bool {
+	if math.IsNaN(value) || value < min || value > max {
+		g.logger.Warn("ignoring invalid GPU reading", "gpu_index", dev.index, "reading", reading, "value", value)
+		return false
+	}
+	return true
+}
+
+// updateTopology compares the GPUs present with the previous complete scrape. when GPUs were
+// added or removed, e.g. by dynamic passthrough into a VM, the change is counted, the state of
+// removed GPUs is purged and added GPUs are registered for events. count is the number of GPUs
+// NVML enumerated. callers must hold devicesMutex.
+func (g *gpuCollector) updateTopology(present map[string]nvml.Device, count int) {
+	changed := len(present) != len(g.present)
+	for uuid, device := range present {
+		if !g.present[uuid] {
+			changed = true
+			g.registerNewEvents(uuid, device)
+		}
+	}
+	if g.present != nil && changed {
+		g.topologyChanges++
+		g.logger.Info("GPU topology changed", "previous_count", len(g.present), "count", len(present))
+	}
+
+	g.present = make(map[string]bool, len(present))
+	for uuid := range present {
+		g.present[uuid] = true
+	}
+	// the index keys of GPUs whose UUID could not be read are stale too
+	for key, state := range g.devices {
+		if !g.present[key] {
+			if state.gpmSample != nil {
+				state.gpmSample.Free()
+			}
+			delete(g.devices, key)
+		}
+	}
+	// so are the GPUs last seen at an NVML index past the enumerated ones, or no longer present,
+	// so a removed GPU is not reported as lost for the life of the process
+	for i, seen := range g.seen {
+		if i >= count || !g.present[seen.uuid] {
+			delete(g.seen, i)
+		}
+	}
+
+	g.eventsMutex.Lock()
+	defer g.eventsMutex.Unlock()
+	for uuid := range g.events {
+		if !g.present[uuid] {
+			delete(g.events, uuid)
+		}
+	}
+}
+
+// registerNewEvents registers a GPU added after startup with the event set, if events are enabled
+func (g *gpuCollector) registerNewEvents(uuid string, device nvml.Device) {
+	g.eventsMutex.Lock()
+	defer g.eventsMutex.Unlock()
+	if g.eventSet == nil || g.events[uuid] != nil {
+		return
+	}
+	if g.registerEvents(g.eventSet, device, uuid) {
+		g.events[uuid] = &gpuEventCounts{}
+	}
+}
+
+// supportedLabels returns the label values of an optional metric the device supports
+func (g *gpuCollector) supportedLabels(dev *gpuDevice) []string {
+	if g.emitUnsupported {
+		return dev.labelsWith("true")
+	}
+	return dev.labels
+}
+
+// unsupported exports a zero valued series labelled supported="false" for an optional metric the
+// device does not support, if --collector.nvidia.emit-unsupported-as-zero is set. only the metrics
+// listed in the flag help use it; keep the list in sync when adding callers.
+func (g *gpuCollector) unsupported(ch chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, dev *gpuDevice) {
+	if g.emitUnsupported {
+		ch <- prometheus.MustNewConstMetric(desc, valueType, 0, dev.labelsWith("false")...)
+	}
+}
+
+// deviceState returns the state for the device identified by uuid, creating it if needed.
+// the GPU index is used as the key when the UUID could not be read. callers must hold devicesMutex.
+func (g *gpuCollector) deviceState(uuid, gpuIndex string) *gpuDeviceState {
+	key := uuid
+	if key == "" {
+		key = "index:" + gpuIndex
+	}
+
+	state, ok := g.devices[key]
+	if !ok {
+		state = &gpuDeviceState{
+			samplesLastSeen: make(map[nvml.SamplingType]uint64),
+		}
+		g.devices[key] = state
+	}
+	return state
+}
+
+// staticInfo returns the static attributes of the device, reading them from NVML on first use.
+// attributes that cannot be read are left empty.
+func (g *gpuCollector) staticInfo(dev *gpuDevice) *gpuStaticInfo {
+	if dev.state.info != nil {
+		return dev.state.info
+	}
+	defer g.observeCall("static_info", time.Now())
+
+	info := &gpuStaticInfo{}
+	var ret nvml.Return
+	if info.serial, ret = dev.GetSerial(); ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU serial", "gpu_index", dev.index, "return", ret)
+	}
+	if info.vbiosVersion, ret = dev.GetVbiosVersion(); ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU VBIOS version", "gpu_index", dev.index, "return", ret)
+	}
+	if info.driverVersion, ret = nvml.SystemGetDriverVersion(); ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get driver version", "return", ret)
+	}
+	info.driverBranch = gpuDriverBranch(info.driverVersion)
+	info.driverType = gpuDriverType()
+	if major, minor, ret := dev.GetCudaComputeCapability(); ret == nvml.SUCCESS {
+		info.computeCapability = fmt.Sprintf("%d.%d", major, minor)
+	} else {
+		g.logger.Debug("failed to get GPU compute capability", "gpu_index", dev.index, "return", ret)
+	}
+	if arch, ret := dev.GetArchitecture(); ret == nvml.SUCCESS {
+		info.architecture = gpuArchitectures[arch]
+		if info.architecture == "" {
+			info.architecture = "unknown"
+		}
+	} else {
+		g.logger.Debug("failed to get GPU architecture", "gpu_index", dev.index, "return", ret)
+	}
+	if brand, ret := dev.GetBrand(); ret == nvml.SUCCESS {
+		info.brand = gpuBrands[brand]
+		if info.brand == "" {
+			info.brand = "unknown"
+		}
+	} else {
+		g.logger.Debug("failed to get GPU brand", "gpu_index", dev.index, "return", ret)
+	}
+	if cpuSet, ret := dev.GetCpuAffinity(gpuMaxCPUs); ret == nvml.SUCCESS {
+		info.cpuAffinity = gpuCPUList(cpuSet)
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		g.logger.Debug("failed to get GPU CPU affinity", "gpu_index", dev.index, "return", ret)
+	}
+
+	dev.state.info = info
+	return info
+}
+
+// gpuCPUList formats a CPU bitmask, 64 CPUs per word, as a list of CPU ranges like the kernel's cpulist files
+func gpuCPUList(cpuSet []uint) string {
+	var ranges []string
+	first := -1
+	for cpu := 0; cpu <= len(cpuSet)*64; cpu++ {
+		set := cpu < len(cpuSet)*64 && cpuSet[cpu/64]&(1<<(cpu%64)) != 0
+		switch {
+		case set && first < 0:
+			first = cpu
+		case !set && first >= 0:
+			if first == cpu-1 {
+				ranges = append(ranges, strconv.Itoa(first))
+			} else {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", first, cpu-1))
+			}
+			first = -1
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+// gpuRetryInsufficientSize calls get again while it fails with ERROR_INSUFFICIENT_SIZE, up to
+// gpuInsufficientSizeAttempts times. it is for the go-nvml list wrappers that size their buffer
+// with a count call and then fill it without growing it, so entries added in between fail the fill.
+func gpuRetryInsufficientSize[T any](get func() (T, nvml.Return)) (T, nvml.Return) {
+	value, ret := get()
+	for attempt := 1; attempt < gpuInsufficientSizeAttempts && ret == nvml.ERROR_INSUFFICIENT_SIZE; attempt++ {
+		value, ret = get()
+	}
+	return value, ret
+}
+
+// gpuSamples are the samples returned by GetSamples
+type gpuSamples struct {
+	valueType nvml.ValueType
+	samples   []nvml.Sample
+}
+
+// samples returns the samples of the given type NVML buffered after lastSeen. GetSamples does not
+// grow its buffer when samples are taken between its count and fill calls, so it is retried.
+func (d *gpuDevice) samples(samplingType nvml.SamplingType, lastSeen uint64) (nvml.ValueType, []nvml.Sample, nvml.Return) {
+	samples, ret := gpuRetryInsufficientSize(func() (gpuSamples, nvml.Return) {
+		valueType, samples, ret := d.GetSamples(samplingType, lastSeen)
+		return gpuSamples{valueType, samples}, ret
+	})
+	return samples.valueType, samples.samples, ret
+}
+
+// newSamples returns the values of the samples of the given type that NVML buffered since the
+// previous call for the device, or nil if there are none
+func (g *gpuCollector) newSamples(dev *gpuDevice, samplingType nvml.SamplingType) []float64 {
+	lastSeen := dev.state.samplesLastSeen[samplingType]
+	valueType, samples, ret := dev.samples(samplingType, lastSeen)
+	if ret == nvml.ERROR_NOT_FOUND || (ret == nvml.SUCCESS && len(samples) == 0) {
+		// no new samples since the last scrape
+		return nil
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU samples", "gpu_index", dev.index, "sampling_type", samplingType, "return", ret)
+		return nil
+	}
+
+	values := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		values = append(values, sampleValue(valueType, sample.SampleValue))
+		if sample.TimeStamp > lastSeen {
+			lastSeen = sample.TimeStamp
+		}
+	}
+	dev.state.samplesLastSeen[samplingType] = lastSeen
+	return values
+}
+
+// updateMemoryTransferred integrates the memory utilisation samples NVML buffered since the last
+// scrape over the peak memory bandwidth into an estimate of the bytes read and written. a sample
+// is the percentage of the time since the previous sample the memory was busy.
+func (g *gpuCollector) updateMemoryTransferred(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("memory_transferred", time.Now())
+
+	if dev.state.memoryBandwidth == 0 {
+		// NVML reports clocks in MHz and the bus width in bits, data is transferred on both clock edges
+		clock, ret := dev.GetMaxClockInfo(nvml.CLOCK_MEM)
+		if ret != nvml.SUCCESS {
+			if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU max memory clock", "gpu_index", dev.index, "return", ret)
+			}
+			return
+		}
+		width, ret := dev.GetMemoryBusWidth()
+		if ret != nvml.SUCCESS {
+			if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU memory bus width", "gpu_index", dev.index, "return", ret)
+			}
+			return
+		}
+		dev.state.memoryBandwidth = float64(clock) * 1e6 * 2 * float64(width) / 8
+	}
+
+	lastSeen := dev.state.samplesLastSeen[nvml.MEMORY_UTILIZATION_SAMPLES]
+	valueType, samples, ret := dev.samples(nvml.MEMORY_UTILIZATION_SAMPLES, lastSeen)
+	switch ret {
+	case nvml.SUCCESS, nvml.ERROR_NOT_FOUND:
+	case nvml.ERROR_NOT_SUPPORTED:
+		return
+	default:
+		g.logger.Debug("failed to get GPU samples", "gpu_index", dev.index, "sampling_type", nvml.MEMORY_UTILIZATION_SAMPLES, "return", ret)
+		return
+	}
+
+	slices.SortFunc(samples, func(a, b nvml.Sample) int { return cmp.Compare(a.TimeStamp, b.TimeStamp) })
+	for _, sample := range samples {
+		if sample.TimeStamp <= lastSeen {
+			continue
+		}
+		// the first sample only marks the start of the integration, timestamps are in microseconds
+		if lastSeen > 0 {
+			busy := sampleValue(valueType, sample.SampleValue) / 100
+			dev.state.memoryBytesTransferred += busy * dev.state.memoryBandwidth * float64(sample.TimeStamp-lastSeen) / 1e6
+		}
+		lastSeen = sample.TimeStamp
+	}
+	dev.state.samplesLastSeen[nvml.MEMORY_UTILIZATION_SAMPLES] = lastSeen
+
+	ch <- prometheus.MustNewConstMetric(g.gpuMemoryTransferredDesc, prometheus.CounterValue, dev.state.memoryBytesTransferred, dev.labels...)
+}
+
+// updatePower exports the instant power draw, and the power averaged by the driver over the
+// last second where the GPU supports it, falling back to the instant reading otherwise. the
+// averaged power is returned if it could be read.
+func (g *gpuCollector) updatePower(ch chan<- prometheus.Metric, dev *gpuDevice) (float64, bool) {
+	defer g.observeCall("power", time.Now())
+
+	// NVML reports power in milliwatts
+	usage, ret := dev.GetPowerUsage()
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU power usage", "gpu_index", dev.index, "return", ret)
+		}
+		return 0, false
+	}
+	watts := float64(usage) / 1000
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerDesc, prometheus.GaugeValue, watts, dev.labels...)
+
+	values := []nvml.FieldValue{{FieldId: nvml.FI_DEV_POWER_AVERAGE, ScopeId: nvml.POWER_SCOPE_GPU}}
+	if ret := dev.GetFieldValues(values); ret == nvml.SUCCESS && nvml.Return(values[0].NvmlReturn) == nvml.SUCCESS {
+		watts = sampleValue(nvml.ValueType(values[0].ValueType), values[0].Value) / 1000
+	} else if ret != nvml.SUCCESS && ret != nvml.ERROR_NOT_SUPPORTED {
+		g.logger.Debug("failed to get GPU average power field value", "gpu_index", dev.index, "return", ret)
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerAverageDesc, prometheus.GaugeValue, watts, dev.labels...)
+	return watts, true
+}
+
+// utilisation in percent up to which a GPU counts as idle for node_gpu_idle_power_waste
+const gpuIdleUtilisation = 1
+
+// updateIdlePowerWaste exports whether the GPU draws more than the idle power threshold
+// while doing no work, e.g. a GPU held by a stopped job or with clocks locked high
+func (g *gpuCollector) updateIdlePowerWaste(ch chan<- prometheus.Metric, dev *gpuDevice, utilisation uint32, watts float64) {
+	waste := utilisation <= gpuIdleUtilisation && watts > *gpuIdlePowerThreshold
+	ch <- prometheus.MustNewConstMetric(g.gpuIdlePowerWasteDesc, prometheus.GaugeValue, boolToFloat64(waste), dev.labels...)
+}
+
+// updatePowerSamples summarises the power samples NVML buffered since the last scrape
+func (g *gpuCollector) updatePowerSamples(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("power_samples", time.Now())
+
+	samples := g.newSamples(dev, nvml.TOTAL_POWER_SAMPLES)
+	if len(samples) == 0 {
+		return
+	}
+
+	var sum float64
+	minPower, maxPower := math.Inf(1), math.Inf(-1)
+	for _, sample := range samples {
+		// power samples are reported in milliwatts
+		watts := sample / 1000
+		sum += watts
+		minPower = math.Min(minPower, watts)
+		maxPower = math.Max(maxPower, watts)
+	}
+
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerAvgDesc, prometheus.GaugeValue, sum/float64(len(samples)), dev.labels...)
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerMinDesc, prometheus.GaugeValue, minPower, dev.labels...)
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerMaxDesc, prometheus.GaugeValue, maxPower, dev.labels...)
+}
+
+// updateUtilisationSamples exports the average of the utilisation samples NVML buffered since the last scrape
+func (g *gpuCollector) updateUtilisationSamples(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("utilisation_samples", time.Now())
+
+	samples := g.newSamples(dev, nvml.GPU_UTILIZATION_SAMPLES)
+	if len(samples) == 0 {
+		return
+	}
+
+	var sum float64
+	for _, sample := range samples {
+		sum += sample
+	}
+	avg := sum / float64(len(samples))
+	if g.validReading(dev, "utilisation_avg", avg, 0, gpuMaxValidUtilisation) {
+		ch <- prometheus.MustNewConstMetric(g.gpuUtilizationAvgDesc, prometheus.GaugeValue, avg, dev.labels...)
+	}
+}
+
+// updateSamplerWindows exports the power and utilisation the internal sampler polled since the last scrape
+func (g *gpuCollector) updateSamplerWindows(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	windows := g.sampler.take(dev.uuid)
+	if power := windows.power; power.count > 0 {
+		ch <- prometheus.MustNewConstMetric(g.gpuPowerAvgDesc, prometheus.GaugeValue, power.sum/float64(power.count), dev.labels...)
+		ch <- prometheus.MustNewConstMetric(g.gpuPowerMinDesc, prometheus.GaugeValue, power.min, dev.labels...)
+		ch <- prometheus.MustNewConstMetric(g.gpuPowerMaxDesc, prometheus.GaugeValue, power.max, dev.labels...)
+	}
+	if utilisation := windows.utilisation; utilisation.count > 0 {
+		ch <- prometheus.MustNewConstMetric(g.gpuUtilizationAvgDesc, prometheus.GaugeValue, utilisation.sum/float64(utilisation.count), dev.labels...)
+		ch <- prometheus.MustNewConstMetric(g.gpuUtilizationMinDesc, prometheus.GaugeValue, utilisation.min, dev.labels...)
+		ch <- prometheus.MustNewConstMetric(g.gpuUtilizationMaxDesc, prometheus.GaugeValue, utilisation.max, dev.labels...)
+	}
+}
+
+// updateFans exports the actual and target speed and the control policy of every fan of the device,
+// passively cooled datacenter GPUs have no fans and report them as not supported
+func (g *gpuCollector) updateFans(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("fans", time.Now())
+
+	fans, ret := dev.GetNumFans()
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU fan count", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	for fan := 0; fan < fans; fan++ {
+		fanLabel := strconv.Itoa(fan)
+		speed, ret := dev.GetFanSpeed_v2(fan)
+		if ret == nvml.SUCCESS {
+			ch <- prometheus.MustNewConstMetric(g.gpuFanSpeedDesc, prometheus.GaugeValue, float64(speed), dev.labelsWith(fanLabel)...)
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU fan speed", "gpu_index", dev.index, "fan", fan, "return", ret)
+		}
+		target, ret := dev.GetTargetFanSpeed(fan)
+		if ret == nvml.SUCCESS {
+			ch <- prometheus.MustNewConstMetric(g.gpuFanTargetSpeedDesc, prometheus.GaugeValue, float64(target), dev.labelsWith(fanLabel)...)
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU fan target speed", "gpu_index", dev.index, "fan", fan, "return", ret)
+		}
+		// NVML_FAN_POLICY_TEMPERATURE_CONTINOUS_SW (0) or NVML_FAN_POLICY_MANUAL (1)
+		policy, ret := dev.GetFanControlPolicy_v2(fan)
+		if ret == nvml.SUCCESS {
+			ch <- prometheus.MustNewConstMetric(g.gpuFanControlPolicyDesc, prometheus.GaugeValue, float64(policy), dev.labelsWith(fanLabel)...)
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU fan control policy", "gpu_index", dev.index, "fan", fan, "return", ret)
+		}
+	}
+}
+
+// updateThermalSensors exports the temperature of every thermal sensor the device reports
+func (g *gpuCollector) updateThermalSensors(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("thermal_sensors", time.Now())
+
+	for sensorIndex := 0; sensorIndex < gpuMaxThermalSensors; sensorIndex++ {
+		settings, ret := dev.GetThermalSettings(uint32(sensorIndex))
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU thermal settings", "gpu_index", dev.index, "sensor", sensorIndex, "return", ret)
+			continue
+		}
+		if settings.Count == 0 {
+			continue
+		}
+
+		sensor := settings.Sensor[0]
+		controller, ok := gpuThermalControllers[nvml.ThermalController(sensor.Controller)]
+		if !ok {
+			controller = "unknown"
+		}
+		target, ok := gpuThermalTargets[nvml.ThermalTarget(sensor.Target)]
+		if !ok {
+			target = "unknown"
+		}
+
+		if !g.validReading(dev, "thermal_sensor_temperature", float64(sensor.CurrentTemp), math.Inf(-1), gpuMaxValidTemperature) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			g.gpuThermalSensorTemperatureDesc,
+			prometheus.GaugeValue,
+			float64(sensor.CurrentTemp),
+			dev.labelsWith(strconv.Itoa(sensorIndex), controller, target)...,
+		)
+	}
+}
+
+// updateMemoryTemperature exports the memory (HBM) temperature and whether it has reached the memory
+// maximum operating temperature, above which the memory is slowed down. it relies on the thresholds
+// cached by updateMaxOperatingTemperatures, and returns the temperature if it could be read.
+func (g *gpuCollector) updateMemoryTemperature(ch chan<- prometheus.Metric, dev *gpuDevice) (float64, bool) {
+	defer g.observeCall("memory_temperature", time.Now())
+
+	values := []nvml.FieldValue{{FieldId: nvml.FI_DEV_MEMORY_TEMP}}
+	if ret := dev.GetFieldValues(values); ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU memory temperature field value", "gpu_index", dev.index, "return", ret)
+		}
+		return 0, false
+	}
+	if nvml.Return(values[0].NvmlReturn) != nvml.SUCCESS {
+		return 0, false
+	}
+	temp := sampleValue(nvml.ValueType(values[0].ValueType), values[0].Value)
+	if temp <= 0 || !g.validReading(dev, "memory_temperature", temp, 0, gpuMaxValidTemperature) {
+		return 0, false
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuMemoryTemperatureDesc, prometheus.GaugeValue, temp, dev.labels...)
+
+	if threshold, ok := dev.state.maxOperatingTemps["memory"]; ok {
+		ch <- prometheus.MustNewConstMetric(g.gpuMemoryTemperatureThrottlingDesc, prometheus.GaugeValue, boolToFloat64(temp >= float64(threshold)), dev.labels...)
+	}
+	return temp, true
+}
+
+// degrees below the memory maximum operating temperature from which a thermal slowdown is
+// attributed to the memory
+const gpuMemoryThermalMargin = 5
+
+// updateMemoryThermalThrottle exports whether the memory, rather than the core, is being slowed
+// down for temperature: a thermal slowdown is active, the memory clock is below its applications
+// clock target and the memory temperature is close to its maximum operating temperature
+func (g *gpuCollector) updateMemoryThermalThrottle(ch chan<- prometheus.Metric, dev *gpuDevice, temp float64, reasons uint64) {
+	defer g.observeCall("memory_thermal_throttle", time.Now())
+
+	threshold, ok := dev.state.maxOperatingTemps["memory"]
+	if !ok {
+		return
+	}
+	current, ret := dev.GetClockInfo(nvml.CLOCK_MEM)
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU memory clock", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	target, ret := dev.GetApplicationsClock(nvml.CLOCK_MEM)
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU memory applications clock", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+
+	throttled := reasons&gpuThermalSlowdownReasons != 0 &&
+		current < target &&
+		temp >= float64(threshold)-gpuMemoryThermalMargin
+	ch <- prometheus.MustNewConstMetric(g.gpuMemoryThermalThrottleDesc, prometheus.GaugeValue, boolToFloat64(throttled), dev.labels...)
+}
+
+// updateMaxOperatingTemperatures exports the maximum operating temperatures, which are
+// static and so only read from NVML once per device
+func (g *gpuCollector) updateMaxOperatingTemperatures(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("max_operating_temperatures", time.Now())
+
+	temps := dev.state.maxOperatingTemps
+	if temps == nil {
+		temps = make(map[string]uint32)
+		complete := true
+		for _, t := range gpuMaxOperatingThresholds {
+			temp, ret := dev.GetTemperatureThreshold(t.threshold)
+			switch ret {
+			case nvml.SUCCESS:
+				if g.validReading(dev, "temperature_max_operating", float64(temp), 0, gpuMaxValidTemperature) {
+					temps[t.sensor] = temp
+				} else {
+					complete = false
+				}
+			case nvml.ERROR_NOT_SUPPORTED:
+			default:
+				g.logger.Debug("failed to get GPU temperature threshold", "gpu_index", dev.index, "sensor", t.sensor, "return", ret)
+				complete = false
+			}
+		}
+		// try again on the next scrape if something other than lack of support failed
+		if complete {
+			dev.state.maxOperatingTemps = temps
+		}
+	}
+
+	for sensor, temp := range temps {
+		ch <- prometheus.MustNewConstMetric(g.gpuTemperatureMaxOperatingDesc, prometheus.GaugeValue, float64(temp), dev.labelsWith(sensor)...)
+	}
+}
+
+// updateFabricInfo exports the NVLink fabric state on systems managed by the fabric manager
+func (g *gpuCollector) updateFabricInfo(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("fabric_info", time.Now())
+
+	info, ret := dev.GetGpuFabricInfo()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU fabric info", "gpu_index", dev.index, "return", ret)
+		return
+	}
+	if info.State == nvml.GPU_FABRIC_STATE_NOT_SUPPORTED {
+		return
+	}
+
+	uuid := info.ClusterUuid
+	clusterUUID := fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+
+	ch <- prometheus.MustNewConstMetric(g.gpuFabricStateDesc, prometheus.GaugeValue, float64(info.State), dev.labelsWith(clusterUUID)...)
+	ch <- prometheus.MustNewConstMetric(g.gpuFabricStatusDesc, prometheus.GaugeValue, float64(info.Status), dev.labelsWith(clusterUUID)...)
+}
+
+// updateVolatileECC exports the corrected (single bit) ECC errors since the last driver load as a counter
+func (g *gpuCollector) updateVolatileECC(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("ecc_volatile", time.Now())
+
+	count, ret := dev.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_CORRECTED, nvml.VOLATILE_ECC)
+	if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_FUNCTION_NOT_FOUND {
+		g.unsupported(ch, g.gpuECCSBEVolatileDesc, prometheus.CounterValue, dev)
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU volatile ECC errors", "gpu_index", dev.index, "return", ret)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(g.gpuECCSBEVolatileDesc, prometheus.CounterValue, float64(count), g.supportedLabels(dev)...)
+}
+
+// updateAggregateECC exports the lifetime uncorrectable ECC error count and whether it is above
+// the RMA threshold. GPUs without ECC, or with ECC disabled, report it as not supported.
+func (g *gpuCollector) updateAggregateECC(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("ecc_aggregate", time.Now())
+
+	count, ret := dev.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.AGGREGATE_ECC)
+	if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_FUNCTION_NOT_FOUND {
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU aggregate ECC errors", "gpu_index", dev.index, "return", ret)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(g.gpuECCDBEAggregateDesc, prometheus.CounterValue, float64(count), dev.labels...)
+	ch <- prometheus.MustNewConstMetric(g.gpuECCRMAThresholdExceededDesc, prometheus.GaugeValue, boolToFloat64(count > uint64(*gpuECCRMAThreshold)), dev.labels...)
+}
+
+// updateSRAMECC exports the SRAM ECC error counters and RMA threshold status (Hopper and newer)
+func (g *gpuCollector) updateSRAMECC(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("sram_ecc", time.Now())
+
+	status, ret := dev.GetSramEccErrorStatus()
+	if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_FUNCTION_NOT_FOUND {
+		g.unsupported(ch, g.gpuSRAMECCThresholdExceededDesc, prometheus.GaugeValue, dev)
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU SRAM ECC error status", "gpu_index", dev.index, "return", ret)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(g.gpuSRAMECCThresholdExceededDesc, prometheus.GaugeValue, boolToFloat64(status.BThresholdExceeded != 0), g.supportedLabels(dev)...)
+	ch <- prometheus.MustNewConstMetric(g.gpuSRAMECCErrorsDesc, prometheus.CounterValue, float64(status.AggregateCor), dev.labelsWith("correctable")...)
+	ch <- prometheus.MustNewConstMetric(g.gpuSRAMECCErrorsDesc, prometheus.CounterValue, float64(status.AggregateUncParity), dev.labelsWith("uncorrectable_parity")...)
+	ch <- prometheus.MustNewConstMetric(g.gpuSRAMECCErrorsDesc, prometheus.CounterValue, float64(status.AggregateUncSecDed), dev.labelsWith("uncorrectable_secded")...)
+}
+
+// violationTimes returns the cumulative violation time in nanoseconds, and the timestamp
+// in microseconds it was read at, of each policy NVML reports
+func (g *gpuCollector) violationTimes(dev *gpuDevice) map[string]nvml.ViolationTime {
+	violations := make(map[string]nvml.ViolationTime)
+	for _, p := range gpuViolationPolicies {
+		violation, ret := dev.GetViolationStatus(p.policy)
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU violation status", "gpu_index", dev.index, "reason", p.reason, "return", ret)
+			continue
+		}
+		violations[p.reason] = violation
+	}
+	return violations
+}
+
+// updateClockEventReasonCounts counts the scrapes each clock event reason was active in, a cheap
+// frequency measure on GPUs without violation times. the unit is scrapes, not time.
+func (g *gpuCollector) updateClockEventReasonCounts(ch chan<- prometheus.Metric, dev *gpuDevice, reasons uint64) {
+	if dev.state.clockEventReasonScrapes == nil {
+		dev.state.clockEventReasonScrapes = make(map[string]uint64)
+	}
+	for _, r := range gpuClockEventReasons {
+		if reasons&r.mask != 0 {
+			dev.state.clockEventReasonScrapes[r.reason]++
+		}
+		ch <- prometheus.MustNewConstMetric(g.gpuClockEventReasonScrapesDesc, prometheus.CounterValue, float64(dev.state.clockEventReasonScrapes[r.reason]), dev.labelsWith(r.reason)...)
+	}
+}
+
+// updateViolations exports the time spent throttled by each policy
+func (g *gpuCollector) updateViolations(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("violations", time.Now())
+
+	violations := g.violationTimes(dev)
+	for reason, violation := range violations {
+		ch <- prometheus.MustNewConstMetric(g.gpuThrottleSecondsDesc, prometheus.CounterValue, float64(violation.ViolationTime)/1e9, dev.labelsWith(reason)...)
+
+		// the first scrape only records the counters, which also restart when the driver reloads
+		previous, seen := dev.state.violations[reason]
+		if !seen || violation.ReferenceTime <= previous.ReferenceTime || violation.ViolationTime < previous.ViolationTime {
+			continue
+		}
+		window := float64(violation.ReferenceTime-previous.ReferenceTime) * 1e3
+		ratio := float64(violation.ViolationTime-previous.ViolationTime) / window
+		if g.validReading(dev, "throttle_ratio", ratio, 0, 1) {
+			ch <- prometheus.MustNewConstMetric(g.gpuThrottleRatioDesc, prometheus.GaugeValue, ratio, dev.labelsWith(reason)...)
+		}
+	}
+	dev.state.violations = violations
+}
+
+// updateEnergyCounterResets counts the energy counter resets seen between scrapes
+func (g *gpuCollector) updateEnergyCounterResets(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("energy_counter", time.Now())
+
+	energy, ret := dev.GetTotalEnergyConsumption()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU total energy consumption", "gpu_index", dev.index, "return", ret)
+		return
+	}
+
+	if dev.state.energySeen && energy < dev.state.energy {
+		dev.state.energyResets++
+	}
+	dev.state.energy = energy
+	dev.state.energySeen = true
+
+	ch <- prometheus.MustNewConstMetric(g.gpuEnergyCounterResetsDesc, prometheus.CounterValue, float64(dev.state.energyResets), dev.labels...)
+	// NVML has no reset counter, a GPU reset or driver reload restarts the energy counter
+	ch <- prometheus.MustNewConstMetric(g.gpuResetsDesc, prometheus.CounterValue, float64(dev.state.energyResets), dev.labelsWith("energy_counter")...)
+}
+
+// updateTopProcesses exports the compute processes using the most memory and the total of the others
+func (g *gpuCollector) updateTopProcesses(ch chan<- prometheus.Metric, dev *gpuDevice, processes []gpuProcess) {
+	var compute []gpuProcess
+	for _, process := range processes {
+		if process.kind == "compute" {
+			compute = append(compute, process)
+		}
+	}
+	slices.SortFunc(compute, func(a, b gpuProcess) int {
+		return cmp.Compare(b.usedMemory, a.usedMemory)
+	})
+
+	var other uint64
+	for i, process := range compute {
+		if i >= *gpuTopProcesses {
+			other += process.usedMemory
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			g.gpuTopProcessMemoryDesc,
+			prometheus.GaugeValue,
+			float64(process.usedMemory),
+			dev.labelsWith(strconv.FormatUint(uint64(process.pid), 10), process.name)...,
+		)
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuOtherProcessMemoryDesc, prometheus.GaugeValue, float64(other), dev.labels...)
+}
+
+// updateMPS exports whether an MPS server holds a context on the device, in which case
+// clients go through it and the compute mode applies to the server rather than to them
+func (g *gpuCollector) updateMPS(ch chan<- prometheus.Metric, dev *gpuDevice, processes []gpuProcess) {
+	active := slices.ContainsFunc(processes, func(process gpuProcess) bool {
+		return process.kind == "compute" && process.name == gpuMPSServerName
+	})
+	ch <- prometheus.MustNewConstMetric(g.gpuMPSActiveDesc, prometheus.GaugeValue, boolToFloat64(active), dev.labels...)
+}
+
+// updateContextCounts exports the number of compute and graphics contexts and of distinct processes on the device.
+// NVML has no per-context information, the process lists hold one entry per process and type of context,
+// so the contexts of a process holding several, e.g. one per CUDA stream pool, cannot be counted.
+func (g *gpuCollector) updateContextCounts(ch chan<- prometheus.Metric, dev *gpuDevice, processes []gpuProcess) {
+	counts := map[string]int{"compute": 0, "graphics": 0}
+	for _, process := range processes {
+		counts[process.kind]++
+	}
+	for kind, count := range counts {
+		ch <- prometheus.MustNewConstMetric(g.gpuContextCountDesc, prometheus.GaugeValue, float64(count), dev.labelsWith(kind)...)
+	}
+
+	// a process with both a compute and a graphics context is listed twice
+	pids := make(map[uint32]bool)
+	for _, process := range processes {
+		pids[process.pid] = true
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuProcessCountDesc, prometheus.GaugeValue, float64(len(pids)), dev.labels...)
+}
+
+// gpuTimesliceReplicas returns the time-slicing replicas from the nvidia.com/gpu.replicas label of
+// a node feature discovery feature file, as written by gpu-feature-discovery, or 0 if it has none
+func gpuTimesliceReplicas(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok && name == "nvidia.com/gpu.replicas" {
+			return strconv.Atoi(value)
+		}
+	}
+	return 0, nil
+}
+
+// runningProcesses returns the compute and graphics processes running on the device. Like the retired
+// pages and accounting pids, the process lists of go-nvml grow their buffer on ERROR_INSUFFICIENT_SIZE
+// until it fits, so callers never see that return code. GetSamples does not, see gpuRetryInsufficientSize.
+func (g *gpuCollector) runningProcesses(dev *gpuDevice) []gpuProcess {
+	defer g.observeCall("processes", time.Now())
+
+	var processes []gpuProcess
+	for _, list := range []struct {
+		kind string
+		get  func() ([]nvml.ProcessInfo, nvml.Return)
+	}{
+		{"compute", dev.computeRunningProcesses},
+		{"graphics", dev.GetGraphicsRunningProcesses},
+	} {
+		infos, ret := list.get()
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU running processes", "gpu_index", dev.index, "type", list.kind, "return", ret)
+			continue
+		}
+		for _, info := range infos {
+			process := gpuProcess{
+				pid:         info.Pid,
+				kind:        list.kind,
+				name:        gpuProcessName(info.Pid),
+				containerID: gpuProcessContainerID(info.Pid),
+				uid:         gpuProcessUID(info.Pid),
+			}
+			// NVML reports NVML_VALUE_NOT_AVAILABLE when it cannot account the memory
+			if info.UsedGpuMemory != math.MaxUint64 {
+				process.usedMemory = info.UsedGpuMemory
+			}
+			processes = append(processes, process)
+		}
+	}
+	return processes
+}
+
+// updateProcesses exports the metrics of every process running on the device
+func (g *gpuCollector) updateProcesses(ch chan<- prometheus.Metric, dev *gpuDevice, processes []gpuProcess) {
+	for _, process := range processes {
 		ch <- prometheus.MustNewConstMetric(
-			g.gpuMemoryFreeDesc,
+			g.gpuProcessMemoryUsedDesc,
 			prometheus.GaugeValue,
-			float64(mem.Free),
-			gpuIndex, name,
+			float64(process.usedMemory),
+			dev.labelsWith(strconv.FormatUint(uint64(process.pid), 10), process.name, process.kind, process.containerID)...,
 		)
-		// export a static metric with GPU information
+	}
+}
+
+// updateUserMemory exports the GPU memory used by the processes of each user on the device
+func (g *gpuCollector) updateUserMemory(ch chan<- prometheus.Metric, dev *gpuDevice, processes []gpuProcess) {
+	usedMemory := make(map[string]uint64)
+	for _, process := range processes {
+		// processes that exited since NVML listed them cannot be attributed to a user
+		if process.uid == "" {
+			continue
+		}
+		usedMemory[process.uid] += process.usedMemory
+	}
+	for uid, used := range usedMemory {
 		ch <- prometheus.MustNewConstMetric(
-			g.gpuInfoDesc,
+			g.gpuUserMemoryDesc,
 			prometheus.GaugeValue,
-			1,
-			gpuIndex, name,
+			float64(used),
+			dev.labelsWith(uid, g.userName(uid))...,
 		)
 	}
+}
+
+// userName returns the name of the user with the given UID from the passwd database,
+// or an empty string if it has no entry. callers must hold devicesMutex.
+func (g *gpuCollector) userName(uid string) string {
+	if name, ok := g.userNames[uid]; ok {
+		return name
+	}
+	// failed lookups are cached as well, so a UID without an entry is not looked up on every scrape
+	var name string
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	} else {
+		g.logger.Debug("failed to look up GPU process user", "uid", uid, "err", err)
+	}
+	g.userNames[uid] = name
+	return name
+}
+
+// gpuSysfsPCIAddress converts an NVML PCI bus id such as 00000000:3B:00.0 to the sysfs
+// device name 0000:3b:00.0, returning an empty string if it cannot be parsed
+func gpuSysfsPCIAddress(busID string) string {
+	domain, bdf, ok := strings.Cut(busID, ":")
+	if !ok {
+		return ""
+	}
+	n, err := strconv.ParseUint(domain, 16, 32)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%04x:%s", n, strings.ToLower(bdf))
+}
+
+// gpuAERTotal reads the value of the total line from a sysfs AER counter file
+func gpuAERTotal(path, total string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(line, " ")
+		if ok && name == total {
+			return strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no %s in %s", total, path)
+}
+
+// gpuDriverBranch returns the release branch of a driver version, e.g. "R550" for 550.54.15
+func gpuDriverBranch(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	if _, err := strconv.Atoi(major); err != nil {
+		return ""
+	}
+	return "R" + major
+}
+
+// gpuDriverNVMLCompatible returns whether an NVML version such as 12.550.54.15, the CUDA major
+// version followed by the version of the driver the library was built for, matches the driver
+// version 550.54.15. ok is false if the NVML version has no driver part.
+func gpuDriverNVMLCompatible(nvmlVersion, driverVersion string) (compatible, ok bool) {
+	_, libraryDriver, found := strings.Cut(nvmlVersion, ".")
+	if !found || !strings.Contains(libraryDriver, ".") {
+		return false, false
+	}
+	return libraryDriver == driverVersion, true
+}
+
+// gpuDriverType returns whether the loaded kernel module is the open or the proprietary
+// one, or an empty string if it cannot be told from /proc/driver/nvidia/version
+func gpuDriverType() string {
+	version, err := os.ReadFile(procFilePath("driver/nvidia/version"))
+	if err != nil {
+		return ""
+	}
+	// e.g. "NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  550.54.15  Release Build ..."
+	line, _, _ := strings.Cut(string(version), "\n")
+	switch {
+	case !strings.HasPrefix(line, "NVRM version:"):
+		return ""
+	case strings.Contains(line, "Open Kernel Module"):
+		return "open"
+	case strings.Contains(line, "Kernel Module"):
+		return "proprietary"
+	}
+	return ""
+}
+
+// gpuProcessName returns the sanitised command name of a process from /proc/<pid>/comm,
+// or an empty string if the process has already exited
+func gpuProcessName(pid uint32) string {
+	comm, err := os.ReadFile(procFilePath(strconv.FormatUint(uint64(pid), 10) + "/comm"))
+	if err != nil {
+		return ""
+	}
+	name := strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(string(comm)))
+	if runes := []rune(name); len(runes) > gpuProcessNameMaxLength {
+		name = string(runes[:gpuProcessNameMaxLength])
+	}
+	return name
+}
+
+// gpuProcessContainerID returns the id of the container a process runs in from
+// /proc/<pid>/cgroup, or an empty string if it cannot be determined
+func gpuProcessContainerID(pid uint32) string {
+	cgroups, err := os.ReadFile(procFilePath(strconv.FormatUint(uint64(pid), 10) + "/cgroup"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path, the v2 hierarchy is "0::<path>"
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if match := gpuContainerIDRegexp.FindStringSubmatch(fields[2]); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// gpuProcessUID returns the real UID of a process from the Uid line of /proc/<pid>/status,
+// or an empty string if the process has already exited
+func gpuProcessUID(pid uint32) string {
+	status, err := os.ReadFile(procFilePath(strconv.FormatUint(uint64(pid), 10) + "/status"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		// Uid: real effective saved filesystem
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// updateAPIRestrictions exports which clock management APIs are restricted to root
+func (g *gpuCollector) updateAPIRestrictions(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("api_restrictions", time.Now())
+
+	for _, api := range gpuRestrictedAPIs {
+		state, ret := dev.GetAPIRestriction(api.api)
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU API restriction", "gpu_index", dev.index, "api", api.name, "return", ret)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(g.gpuAPIRestrictionDesc, prometheus.GaugeValue, boolToFloat64(state == nvml.FEATURE_ENABLED), dev.labelsWith(api.name)...)
+	}
+}
+
+// updatePowerSource exports the power source on boards that report one
+func (g *gpuCollector) updatePowerSource(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("power_source", time.Now())
+
+	source, ret := dev.GetPowerSource()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		g.unsupported(ch, g.gpuPowerSourceDesc, prometheus.GaugeValue, dev)
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU power source", "gpu_index", dev.index, "return", ret)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerSourceDesc, prometheus.GaugeValue, float64(source), g.supportedLabels(dev)...)
+}
+
+// updateDRAMBandwidth exports the DRAM bandwidth utilisation between this scrape and the previous
+// one from GPM, falling back to the coarser memory utilisation rate on devices without GPM. the
+// utilisation of the finer GPM domains and the tensor pipe activity are computed from the same pair of samples.
+func (g *gpuCollector) updateDRAMBandwidth(ch chan<- prometheus.Metric, dev *gpuDevice, memoryUtilisation uint32) {
+	defer g.observeCall("dram_bandwidth", time.Now())
+
+	support, ret := dev.GpmQueryDeviceSupport()
+	if ret != nvml.SUCCESS || support.IsSupportedDevice == 0 {
+		if ret != nvml.SUCCESS && ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to query GPU GPM support", "gpu_index", dev.index, "return", ret)
+		}
+		if g.validReading(dev, "dram_bandwidth_utilisation", float64(memoryUtilisation), 0, gpuMaxValidUtilisation) {
+			ch <- prometheus.MustNewConstMetric(g.gpuDRAMBandwidthDesc, prometheus.GaugeValue, float64(memoryUtilisation), dev.labelsWith("utilisation_rates")...)
+		}
+		return
+	}
+
+	sample, ret := nvml.GpmSampleAlloc()
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to allocate GPU GPM sample", "gpu_index", dev.index, "return", ret)
+		return
+	}
+	if ret := dev.GpmSampleGet(sample); ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU GPM sample", "gpu_index", dev.index, "return", ret)
+		sample.Free()
+		return
+	}
+
+	// GPM metrics are computed over the interval between two samples, so the
+	// first scrape only records a sample
+	previous := dev.state.gpmSample
+	dev.state.gpmSample = sample
+	if previous == nil {
+		return
+	}
+	defer previous.Free()
+
+	// the DRAM bandwidth, the domains and the integer tensor pipes. NVML has no GPM metric
+	// for the FP8 tensor pipes, their activity is only part of GPM_METRIC_ANY_TENSOR_UTIL.
+	integerTensor := 1 + len(gpuGPMDomains)
+	metrics := nvml.GpmMetricsGetType{
+		NumMetrics: uint32(integerTensor + 1),
+		Sample1:    previous,
+		Sample2:    sample,
+	}
+	metrics.Metrics[0].MetricId = uint32(nvml.GPM_METRIC_DRAM_BW_UTIL)
+	for i, domain := range gpuGPMDomains {
+		metrics.Metrics[1+i].MetricId = uint32(domain.metric)
+	}
+	metrics.Metrics[integerTensor].MetricId = uint32(nvml.GPM_METRIC_IMMA_TENSOR_UTIL)
+	if ret := nvml.GpmMetricsGet(&metrics); ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU GPM metrics", "gpu_index", dev.index, "return", ret)
+		return
+	}
+	if ret := nvml.Return(metrics.Metrics[0].NvmlReturn); ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU DRAM bandwidth utilisation", "gpu_index", dev.index, "return", ret)
+	} else if value := metrics.Metrics[0].Value; g.validReading(dev, "dram_bandwidth_utilisation", value, 0, gpuMaxValidUtilisation) {
+		ch <- prometheus.MustNewConstMetric(g.gpuDRAMBandwidthDesc, prometheus.GaugeValue, value, dev.labelsWith("gpm")...)
+	}
+
+	// domains the GPU does not implement return an error and are skipped
+	for i, domain := range gpuGPMDomains {
+		metric := metrics.Metrics[1+i]
+		if nvml.Return(metric.NvmlReturn) != nvml.SUCCESS {
+			continue
+		}
+		if g.validReading(dev, "domain_utilisation", metric.Value, 0, gpuMaxValidUtilisation) {
+			ch <- prometheus.MustNewConstMetric(g.gpuDomainUtilisationDesc, prometheus.GaugeValue, metric.Value, dev.labelsWith(domain.name)...)
+		}
+	}
+	if metric := metrics.Metrics[integerTensor]; nvml.Return(metric.NvmlReturn) == nvml.SUCCESS &&
+		g.validReading(dev, "gpm_integer_activity", metric.Value, 0, gpuMaxValidUtilisation) {
+		ch <- prometheus.MustNewConstMetric(g.gpuGPMIntegerActivityDesc, prometheus.GaugeValue, metric.Value, dev.labels...)
+	}
+}
+
+// updateExclusiveModeOccupied exports whether an exclusive process device already has its one compute context
+func (g *gpuCollector) updateExclusiveModeOccupied(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("exclusive_mode", time.Now())
+
+	mode, ret := dev.GetComputeMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU compute mode", "gpu_index", dev.index, "return", ret)
+		return
+	}
+
+	occupied := false
+	if mode == nvml.COMPUTEMODE_EXCLUSIVE_PROCESS {
+		processes, ret := dev.computeRunningProcesses()
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU running processes", "gpu_index", dev.index, "type", "compute", "return", ret)
+			return
+		}
+		occupied = len(processes) > 0
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuExclusiveModeOccupiedDesc, prometheus.GaugeValue, boolToFloat64(occupied), dev.labels...)
+}
+
+// updatePowerRails exports the instant power draw of every rail the board reports
+func (g *gpuCollector) updatePowerRails(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("power_rails", time.Now())
+
+	values := make([]nvml.FieldValue, len(gpuPowerRails))
+	for i, rail := range gpuPowerRails {
+		values[i] = nvml.FieldValue{FieldId: nvml.FI_DEV_POWER_INSTANT, ScopeId: rail.scope}
+	}
+	if ret := dev.GetFieldValues(values); ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU power rail field values", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+
+	for i, rail := range gpuPowerRails {
+		if nvml.Return(values[i].NvmlReturn) != nvml.SUCCESS {
+			continue
+		}
+		// NVML reports power in milliwatts
+		watts := sampleValue(nvml.ValueType(values[i].ValueType), values[i].Value) / 1000
+		ch <- prometheus.MustNewConstMetric(g.gpuPowerRailDesc, prometheus.GaugeValue, watts, dev.labelsWith(rail.name)...)
+	}
+}
+
+// updateVideoClock exports the video engine clock and its ratio to the maximum video clock
+func (g *gpuCollector) updateVideoClock(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("video_clock", time.Now())
+
+	// NVML reports clocks in MHz
+	current, ret := dev.GetClockInfo(nvml.CLOCK_VIDEO)
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU video clock", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuVideoClockDesc, prometheus.GaugeValue, float64(current)*1e6, dev.labels...)
+
+	maxClock, ret := dev.GetMaxClockInfo(nvml.CLOCK_VIDEO)
+	if ret != nvml.SUCCESS || maxClock == 0 {
+		if ret != nvml.SUCCESS && ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU max video clock", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuVideoClockRatioDesc, prometheus.GaugeValue, float64(current)/float64(maxClock), dev.labels...)
+}
+
+// updateMaxCustomerBoostClock exports the advertised boost clock ceiling of the graphics domain
+func (g *gpuCollector) updateMaxCustomerBoostClock(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("max_customer_boost_clock", time.Now())
+
+	// NVML reports clocks in MHz
+	clock, ret := dev.GetMaxCustomerBoostClock(nvml.CLOCK_GRAPHICS)
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU max customer boost clock", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuMaxCustomerBoostClockDesc, prometheus.GaugeValue, float64(clock)*1e6, dev.labels...)
+}
+
+// updatePeakFP32 exports the theoretical peak FP32 throughput, which only depends on static
+// attributes and so is read from NVML once per device
+func (g *gpuCollector) updatePeakFP32(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("peak_fp32", time.Now())
+
+	if dev.state.peakFP32TFLOPS == 0 {
+		cores, ret := dev.GetNumGpuCores()
+		if ret != nvml.SUCCESS {
+			if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU core count", "gpu_index", dev.index, "return", ret)
+			}
+			return
+		}
+		// NVML reports clocks in MHz
+		clock, ret := dev.GetMaxClockInfo(nvml.CLOCK_SM)
+		if ret != nvml.SUCCESS {
+			if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU max SM clock", "gpu_index", dev.index, "return", ret)
+			}
+			return
+		}
+		dev.state.peakFP32TFLOPS = float64(cores) * float64(clock) * 1e6 * 2 / 1e12
+	}
+	if dev.state.peakFP32TFLOPS > 0 {
+		ch <- prometheus.MustNewConstMetric(g.gpuPeakFP32TFLOPSDesc, prometheus.GaugeValue, dev.state.peakFP32TFLOPS, dev.labels...)
+	}
+}
+
+// updateClockOffsets exports the GPC and memory clock offsets, e.g. set by overclocking tools
+func (g *gpuCollector) updateClockOffsets(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("clock_offsets", time.Now())
+
+	for _, clock := range []struct {
+		desc *prometheus.Desc
+		name string
+		get  func() (int, nvml.Return)
+	}{
+		{g.gpuGPCClockOffsetDesc, "gpc", dev.GetGpcClkVfOffset},
+		{g.gpuMemClockOffsetDesc, "mem", dev.GetMemClkVfOffset},
+	} {
+		offset, ret := clock.get()
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU clock offset", "gpu_index", dev.index, "clock", clock.name, "return", ret)
+			continue
+		}
+		// NVML reports offsets in MHz
+		ch <- prometheus.MustNewConstMetric(clock.desc, prometheus.GaugeValue, float64(offset)*1e6, dev.labels...)
+	}
+}
+
+// updateClockOffsetBounds exports the range the GPC and memory clock offsets can be set within,
+// to check that voltage/frequency curve tuning stays within what the GPU allows
+func (g *gpuCollector) updateClockOffsetBounds(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("clock_offset_bounds", time.Now())
+
+	for _, clock := range []struct {
+		name string
+		get  func() (int, int, nvml.Return)
+	}{
+		{"gpc", dev.GetGpcClkMinMaxVfOffset},
+		{"mem", dev.GetMemClkMinMaxVfOffset},
+	} {
+		minOffset, maxOffset, ret := clock.get()
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU clock offset bounds", "gpu_index", dev.index, "clock", clock.name, "return", ret)
+			continue
+		}
+		// NVML reports offsets in MHz
+		ch <- prometheus.MustNewConstMetric(g.gpuVFCurveMinOffsetDesc, prometheus.GaugeValue, float64(minOffset)*1e6, dev.labelsWith(clock.name)...)
+		ch <- prometheus.MustNewConstMetric(g.gpuVFCurveMaxOffsetDesc, prometheus.GaugeValue, float64(maxOffset)*1e6, dev.labelsWith(clock.name)...)
+	}
+}
+
+// updateEncoderSessions exports the number of active encoder sessions; NVML has no
+// equivalent for NVDEC, so decoder sessions cannot be reported
+func (g *gpuCollector) updateEncoderSessions(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("encoder_stats", time.Now())
+
+	sessions, _, _, ret := dev.GetEncoderStats()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU encoder stats", "gpu_index", dev.index, "return", ret)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuEncoderSessionsDesc, prometheus.GaugeValue, float64(sessions), dev.labels...)
+}
+
+// updateBusyTime advances the busy time counter by the current utilisation over the time
+// since the previous scrape. The utilisation is sampled once per scrape, so bursts shorter
+// than the scrape interval are only accounted as far as they show up in that reading.
+func (g *gpuCollector) updateBusyTime(ch chan<- prometheus.Metric, dev *gpuDevice, utilisation uint32) {
+	if !g.validReading(dev, "busy_time", float64(utilisation), 0, gpuMaxValidUtilisation) {
+		return
+	}
+
+	now := time.Now()
+	if !dev.state.busyUpdated.IsZero() {
+		dev.state.busySeconds += now.Sub(dev.state.busyUpdated).Seconds() * float64(utilisation) / 100
+	}
+	dev.state.busyUpdated = now
+	ch <- prometheus.MustNewConstMetric(g.gpuBusySecondsDesc, prometheus.CounterValue, dev.state.busySeconds, dev.labels...)
+}
+
+// reservedMemory returns the memory held back for system use, which explains the gap
+// between the advertised memory size and what applications can allocate
+func (g *gpuCollector) reservedMemory(dev *gpuDevice) (uint64, bool) {
+	defer g.observeCall("memory_v2", time.Now())
+
+	mem, ret := dev.GetMemoryInfo_v2()
+	if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_FUNCTION_NOT_FOUND {
+		return 0, false
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU memory info v2", "gpu_index", dev.index, "return", ret)
+		return 0, false
+	}
+	if !g.validReading(dev, "memory_reserved", float64(mem.Reserved), 0, float64(mem.Total)) {
+		return 0, false
+	}
+	return mem.Reserved, true
+}
+
+// updateECCMode exports whether a pending ECC mode change needs a reboot, and returns the
+// current ECC mode of the device if it supports ECC
+func (g *gpuCollector) updateECCMode(ch chan<- prometheus.Metric, dev *gpuDevice) (nvml.EnableState, bool) {
+	defer g.observeCall("ecc_mode", time.Now())
+
+	current, pending, ret := dev.GetEccMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return 0, false
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU ECC mode", "gpu_index", dev.index, "return", ret)
+		return 0, false
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuECCRebootRequiredDesc, prometheus.GaugeValue, boolToFloat64(current != pending), dev.labels...)
+	return current, true
+}
+
+// updateEventCounts exports the counters maintained from NVML events for the device
+func (g *gpuCollector) updateEventCounts(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	g.eventsMutex.Lock()
+	defer g.eventsMutex.Unlock()
+
+	counts := g.events[dev.uuid]
+	if counts == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuThermalThresholdCrossingsDesc, prometheus.CounterValue, float64(counts.thermalCrossings), dev.labels...)
+	ch <- prometheus.MustNewConstMetric(g.gpuECCSBEEventsDesc, prometheus.CounterValue, float64(counts.sbeEvents), dev.labels...)
+}
+
+// clocksLocked returns whether the clocks of the device are locked, given its current clock event
+// reasons. locked clocks (nvidia-smi -lgc) and applications clocks (nvidia-smi -ac) are both reported
+// through the applications clocks setting reason while they hold the clocks back. applications
+// clocks are also compared with their defaults, so they are seen on an idle GPU too.
+func (g *gpuCollector) clocksLocked(dev *gpuDevice, reasons uint64) bool {
+	if reasons&nvml.ClocksEventReasonApplicationsClocksSetting != 0 {
+		return true
+	}
+	for _, clockType := range []nvml.ClockType{nvml.CLOCK_GRAPHICS, nvml.CLOCK_MEM} {
+		clock, ret := dev.GetApplicationsClock(clockType)
+		if ret != nvml.SUCCESS {
+			if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU applications clock", "gpu_index", dev.index, "clock", clockType, "return", ret)
+			}
+			continue
+		}
+		defaultClock, ret := dev.GetDefaultApplicationsClock(clockType)
+		if ret != nvml.SUCCESS {
+			if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU default applications clock", "gpu_index", dev.index, "clock", clockType, "return", ret)
+			}
+			continue
+		}
+		if clock != defaultClock {
+			return true
+		}
+	}
+	return false
+}
+
+// updateNvLinks exports the metrics of every active NVLink of the device
+func (g *gpuCollector) updateNvLinks(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("nvlink", time.Now())
+
+	links, down := 0, 0
+	// bit i is set when link i is up, NVLINK_MAX_LINKS bits fit a float64 exactly
+	var upMask uint64
+	for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+		state, ret := dev.GetNvLinkState(link)
+		// devices without NVLink report not supported, links past the last one an invalid argument
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			break
+		}
+		if ret != nvml.SUCCESS {
+			g.logger.Debug("failed to get GPU NVLink state", "gpu_index", dev.index, "link", link, "return", ret)
+			continue
+		}
+		links++
+		if state != nvml.FEATURE_ENABLED {
+			down++
+			continue
+		}
+		upMask |= 1 << link
+		g.updateNvLinkUtilisation(ch, dev, link)
+	}
+
+	if links > 0 {
+		ch <- prometheus.MustNewConstMetric(g.gpuNvLinkLinksDesc, prometheus.GaugeValue, float64(links), dev.labels...)
+		ch <- prometheus.MustNewConstMetric(g.gpuNvLinkDownDesc, prometheus.GaugeValue, float64(down), dev.labels...)
+		ch <- prometheus.MustNewConstMetric(g.gpuNvLinkStateBitmaskDesc, prometheus.GaugeValue, float64(upMask), dev.labels...)
+	}
+}
+
+// updateNvLinkUtilisation exports the throughput of a link since the previous scrape relative
+// to the bandwidth of its NVLink version
+func (g *gpuCollector) updateNvLinkUtilisation(ch chan<- prometheus.Metric, dev *gpuDevice, link int) {
+	version, ret := dev.GetNvLinkVersion(link)
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU NVLink version", "gpu_index", dev.index, "link", link, "return", ret)
+		return
+	}
+	bandwidth, ok := gpuNvLinkBandwidths[version]
+	if !ok {
+		g.logger.Debug("unknown NVLink version", "gpu_index", dev.index, "link", link, "version", version)
+		return
+	}
+
+	values := make([]nvml.FieldValue, len(gpuNvLinkThroughputFields))
+	for i, field := range gpuNvLinkThroughputFields {
+		values[i] = nvml.FieldValue{FieldId: field.field, ScopeId: uint32(link)}
+	}
+	if ret := dev.GetFieldValues(values); ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU NVLink throughput field values", "gpu_index", dev.index, "link", link, "return", ret)
+		return
+	}
+
+	if dev.state.nvlinkThroughput == nil {
+		dev.state.nvlinkThroughput = make(map[gpuNvLinkCounter]gpuFieldSample)
+	}
+	for i, field := range gpuNvLinkThroughputFields {
+		if nvml.Return(values[i].NvmlReturn) != nvml.SUCCESS {
+			continue
+		}
+		counter := gpuNvLinkCounter{link: link, direction: field.direction}
+		sample := gpuFieldSample{
+			value:     sampleValue(nvml.ValueType(values[i].ValueType), values[i].Value) * 1024,
+			timestamp: values[i].Timestamp,
+		}
+		previous, seen := dev.state.nvlinkThroughput[counter]
+		dev.state.nvlinkThroughput[counter] = sample
+
+		// the first scrape only records the counters, and counters reset with the driver
+		elapsed := float64(sample.timestamp-previous.timestamp) / 1e6
+		if !seen || elapsed <= 0 || sample.value < previous.value {
+			continue
+		}
+		utilisation := (sample.value - previous.value) / elapsed / bandwidth * 100
+		if g.validReading(dev, "nvlink_utilisation", utilisation, 0, gpuMaxValidUtilisation) {
+			ch <- prometheus.MustNewConstMetric(g.gpuNvLinkUtilisationDesc, prometheus.GaugeValue, utilisation, dev.labelsWith(strconv.Itoa(link), field.direction)...)
+		}
+	}
+}
+
+// updatePCIeUtilisation exports the PCIe throughput relative to the bandwidth of the current
+// link generation and width
+func (g *gpuCollector) updatePCIeUtilisation(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("pcie_utilisation", time.Now())
+
+	generation, ret := dev.GetCurrPcieLinkGeneration()
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU PCIe link generation", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	width, ret := dev.GetCurrPcieLinkWidth()
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU PCIe link width", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	laneBandwidth, ok := gpuPCIeLaneBandwidths[generation]
+	if !ok || width <= 0 {
+		g.logger.Debug("unknown PCIe link", "gpu_index", dev.index, "generation", generation, "width", width)
+		return
+	}
+	bandwidth := laneBandwidth * float64(width)
+
+	for _, counter := range gpuPCIeThroughputCounters {
+		throughput, ret := dev.GetPcieThroughput(counter.counter)
+		if ret != nvml.SUCCESS {
+			if ret != nvml.ERROR_NOT_SUPPORTED {
+				g.logger.Debug("failed to get GPU PCIe throughput", "gpu_index", dev.index, "direction", counter.direction, "return", ret)
+			}
+			continue
+		}
+		utilisation := float64(throughput) * 1024 / bandwidth * 100
+		if g.validReading(dev, "pcie_utilisation", utilisation, 0, gpuMaxValidUtilisation) {
+			ch <- prometheus.MustNewConstMetric(g.gpuPCIeUtilisationDesc, prometheus.GaugeValue, utilisation, dev.labelsWith(counter.direction)...)
+		}
+	}
+}
+
+// updatePowerManagement exports whether power management is enabled on the device
+func (g *gpuCollector) updatePowerManagement(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("power_management", time.Now())
+
+	mode, ret := dev.GetPowerManagementMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		g.unsupported(ch, g.gpuPowerManagementDesc, prometheus.GaugeValue, dev)
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU power management mode", "gpu_index", dev.index, "return", ret)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerManagementDesc, prometheus.GaugeValue, boolToFloat64(mode == nvml.FEATURE_ENABLED), g.supportedLabels(dev)...)
+}
+
+// updatePersistenceMode exports whether persistence mode is enabled, and whether it differs
+// from --collector.nvidia.expect-persistence if that is set
+func (g *gpuCollector) updatePersistenceMode(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	defer g.observeCall("persistence_mode", time.Now())
+
+	mode, ret := dev.GetPersistenceMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU persistence mode", "gpu_index", dev.index, "return", ret)
+		return
+	}
+
+	enabled := mode == nvml.FEATURE_ENABLED
+	ch <- prometheus.MustNewConstMetric(g.gpuPersistenceModeDesc, prometheus.GaugeValue, boolToFloat64(enabled), dev.labels...)
+	if *gpuExpectPersistence != "" {
+		ch <- prometheus.MustNewConstMetric(g.gpuPersistenceModeMismatchDesc, prometheus.GaugeValue, boolToFloat64(enabled != (*gpuExpectPersistence == "on")), dev.labels...)
+	}
+}
+
+// updateDriverNVMLCompatible exports whether the NVML library was built for the loaded driver. a
+// library from another driver release, e.g. bundled with a newer CUDA toolkit, can fail or return
+// wrong values for calls the loaded driver implements differently.
+func (g *gpuCollector) updateDriverNVMLCompatible(ch chan<- prometheus.Metric) {
+	defer g.observeCall("nvml_version", time.Now())
+
+	nvmlVersion, ret := nvml.SystemGetNVMLVersion()
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get NVML version", "return", ret)
+		return
+	}
+	driverVersion, ret := nvml.SystemGetDriverVersion()
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get driver version", "return", ret)
+		return
+	}
+	compatible, ok := gpuDriverNVMLCompatible(nvmlVersion, driverVersion)
+	if !ok {
+		g.logger.Debug("unexpected NVML version format", "nvml_version", nvmlVersion)
+		return
+	}
+	if !compatible {
+		g.logger.Warn("NVML library does not match the loaded driver", "nvml_version", nvmlVersion, "driver_version", driverVersion)
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuDriverNVMLCompatibleDesc, prometheus.GaugeValue, boolToFloat64(compatible))
+}
+
+// updatePowerLimitChanges counts changes of the enforced power limit, e.g. through nvidia-smi -pl,
+// and returns the enforced limit in milliwatts if it could be read
+func (g *gpuCollector) updatePowerLimitChanges(ch chan<- prometheus.Metric, dev *gpuDevice) (uint32, bool) {
+	defer g.observeCall("power_limit", time.Now())
+
+	limit, ret := dev.GetEnforcedPowerLimit()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return 0, false
+	}
+	if ret != nvml.SUCCESS {
+		g.logger.Debug("failed to get GPU enforced power limit", "gpu_index", dev.index, "return", ret)
+		return 0, false
+	}
+
+	state := dev.state
+	if state.powerLimitSeen && limit != state.powerLimit {
+		g.logger.Info("GPU enforced power limit changed", "gpu_index", dev.index, "from_milliwatts", state.powerLimit, "to_milliwatts", limit)
+		state.powerLimitChanges++
+	}
+	state.powerLimit = limit
+	state.powerLimitSeen = true
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerLimitChangesDesc, prometheus.CounterValue, float64(state.powerLimitChanges), dev.labels...)
+	return limit, true
+}
+
+// updatePowerLimitSource exports whether the default limit, a user set limit or a hardware brake
+// is holding the GPU to its power, from the enforced limit in milliwatts and the clock event reasons
+func (g *gpuCollector) updatePowerLimitSource(ch chan<- prometheus.Metric, dev *gpuDevice, enforced uint32, reasons uint64) {
+	defer g.observeCall("power_limit_source", time.Now())
+
+	defaultLimit, ret := dev.GetPowerManagementDefaultLimit()
+	if ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU default power limit", "gpu_index", dev.index, "return", ret)
+		}
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuPowerLimitSourceDesc, prometheus.GaugeValue, float64(gpuPowerLimitSource(enforced, defaultLimit, reasons)), dev.labels...)
+}
+
+// updateBoardPowerLimit exports the power limit of the whole module (TGP), which on datacenter
+// boards can differ from the software settable GPU limit, and the share of it the enforced limit allows
+func (g *gpuCollector) updateBoardPowerLimit(ch chan<- prometheus.Metric, dev *gpuDevice, enforced uint32, enforcedOK bool) {
+	defer g.observeCall("board_power_limit", time.Now())
+
+	values := []nvml.FieldValue{{FieldId: nvml.FI_DEV_POWER_CURRENT_LIMIT, ScopeId: nvml.POWER_SCOPE_MODULE}}
+	if ret := dev.GetFieldValues(values); ret != nvml.SUCCESS {
+		if ret != nvml.ERROR_NOT_SUPPORTED {
+			g.logger.Debug("failed to get GPU board power limit field value", "gpu_index", dev.index, "return", ret)
+		} else {
+			g.unsupported(ch, g.gpuBoardPowerLimitDesc, prometheus.GaugeValue, dev)
+		}
+		return
+	}
+	if ret := nvml.Return(values[0].NvmlReturn); ret != nvml.SUCCESS {
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			g.unsupported(ch, g.gpuBoardPowerLimitDesc, prometheus.GaugeValue, dev)
+		}
+		return
+	}
+
+	// NVML reports power in milliwatts
+	limit := sampleValue(nvml.ValueType(values[0].ValueType), values[0].Value)
+	if limit <= 0 {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.gpuBoardPowerLimitDesc, prometheus.GaugeValue, limit/1000, g.supportedLabels(dev)...)
+	if enforcedOK {
+		ch <- prometheus.MustNewConstMetric(g.gpuBoardPowerLimitRatioDesc, prometheus.GaugeValue, float64(enforced)/limit, dev.labels...)
+	}
+}
+
+// updatePCIeAER exports the AER error totals the kernel keeps for the PCI device of the GPU
+func (g *gpuCollector) updatePCIeAER(ch chan<- prometheus.Metric, dev *gpuDevice) {
+	address := gpuSysfsPCIAddress(dev.pciBusID)
+	if address == "" {
+		return
+	}
+	for _, counter := range gpuAERCounters {
+		total, err := gpuAERTotal(sysFilePath(filepath.Join("bus/pci/devices", address, counter.file)), counter.total)
+		if err != nil {
+			// kernels without AER support, or devices without the capability, have no counters
+			if !errors.Is(err, os.ErrNotExist) {
+				g.logger.Debug("failed to read GPU AER counters", "gpu_index", dev.index, "type", counter.kind, "err", err)
+			}
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(g.gpuPCIeAERErrorsDesc, prometheus.CounterValue, float64(total), dev.labelsWith(counter.kind)...)
+	}
+}
+
+// updateP2PStatus exports the peer-to-peer capabilities between every pair of devices
+func (g *gpuCollector) updateP2PStatus(ch chan<- prometheus.Metric, devices []*gpuDevice) {
+	defer g.observeCall("p2p_status", time.Now())
+
+	for _, dev := range devices {
+		for _, peer := range devices {
+			if peer == dev {
+				continue
+			}
+			for _, capability := range gpuP2PCapabilities {
+				status, ret := dev.GetP2PStatus(peer.Device, capability.index)
+				if ret != nvml.SUCCESS {
+					g.logger.Debug("failed to get GPU P2P status", "gpu_index", dev.index, "peer_index", peer.gpuIndex, "capability", capability.name, "return", ret)
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(
+					g.gpuP2PStatusDesc,
+					prometheus.GaugeValue,
+					boolToFloat64(status == nvml.P2P_STATUS_OK),
+					dev.labelsWith(peer.gpuIndex, capability.name)...,
+				)
+			}
+		}
+	}
+}
+
+// sampleValue decodes the union held in an NVML sample according to its value type
+func sampleValue(valueType nvml.ValueType, value [8]byte) float64 {
+	switch valueType {
+	case nvml.VALUE_TYPE_DOUBLE:
+		return math.Float64frombits(binary.NativeEndian.Uint64(value[:]))
+	case nvml.VALUE_TYPE_UNSIGNED_INT:
+		return float64(binary.NativeEndian.Uint32(value[:]))
+	case nvml.VALUE_TYPE_UNSIGNED_LONG, nvml.VALUE_TYPE_UNSIGNED_LONG_LONG:
+		return float64(binary.NativeEndian.Uint64(value[:]))
+	case nvml.VALUE_TYPE_SIGNED_LONG_LONG:
+		return float64(int64(binary.NativeEndian.Uint64(value[:])))
+	case nvml.VALUE_TYPE_SIGNED_INT:
+		return float64(int32(binary.NativeEndian.Uint32(value[:])))
+	default:
+		return math.NaN()
+	}
+}
+
+// int8ToString converts a NUL terminated C char array as returned by NVML to a string
+func int8ToString(chars []int8) string {
+	b := make([]byte, 0, len(chars))
+	for _, c := range chars {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
+
+// boolToFloat64 converts a boolean to the 0/1 value used for boolean metrics
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
 
+// gpuSelfTestCheck is a single NVML read attempted by GPUSelfTest
+type gpuSelfTestCheck struct {
+	name string
+	read func(device nvml.Device) nvml.Return
+}
+
+// gpuSelfTestChecks lists one read for each group of metrics the collector exports
+var gpuSelfTestChecks = []gpuSelfTestCheck{
+	{"name", func(d nvml.Device) nvml.Return { _, ret := d.GetName(); return ret }},
+	{"uuid", func(d nvml.Device) nvml.Return { _, ret := d.GetUUID(); return ret }},
+	{"utilisation", func(d nvml.Device) nvml.Return { _, ret := d.GetUtilizationRates(); return ret }},
+	{"temperature", func(d nvml.Device) nvml.Return { _, ret := d.GetTemperature(nvml.TEMPERATURE_GPU); return ret }},
+	{"memory", func(d nvml.Device) nvml.Return { _, ret := d.GetMemoryInfo(); return ret }},
+	{"power_samples", func(d nvml.Device) nvml.Return {
+		_, _, ret := d.GetSamples(nvml.TOTAL_POWER_SAMPLES, 0)
+		if ret == nvml.ERROR_NOT_FOUND {
+			// no samples buffered yet, but the call itself works
+			return nvml.SUCCESS
+		}
+		return ret
+	}},
+	{"thermal_settings", func(d nvml.Device) nvml.Return { _, ret := d.GetThermalSettings(0); return ret }},
+	{"clock_event_reasons", func(d nvml.Device) nvml.Return { _, ret := d.GetCurrentClocksEventReasons(); return ret }},
+}
+
+// GPUSelfTest initialises NVML, enumerates the GPUs and attempts each of the reads
+// the collector relies on, logging which succeed and which fail. NVML is shut down
+// again before returning. an error is returned if NVML is unusable or any read failed,
+// reads that are merely unsupported by the hardware are not counted as failures.
+func GPUSelfTest(logger *slog.Logger) error {
+	ret := gpuInitNVML(logger)
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("could not initialise NVML: %v", ret)
+	}
+	defer func() {
+		if ret := nvml.Shutdown(); ret != nvml.SUCCESS {
+			logger.Warn("failed to shut down NVML", "return", ret)
+		}
+	}()
+
+	if version, ret := nvml.SystemGetDriverVersion(); ret == nvml.SUCCESS {
+		logger.Info("NVML initialised", "driver_version", version)
+	}
+
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("could not retrieve GPU count: %v", ret)
+	}
+	if count == 0 {
+		return errors.New("no NVIDIA GPUs found")
+	}
+	logger.Info("found NVIDIA GPUs", "count", count)
+
+	failed := 0
+	for i := 0; i < count; i++ {
+		device, ret := nvml.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			logger.Error("failed to get handle for GPU device", "gpu_index", i, "return", ret)
+			failed++
+			continue
+		}
+		for _, check := range gpuSelfTestChecks {
+			switch ret := check.read(device); ret {
+			case nvml.SUCCESS:
+				logger.Info("self-test read succeeded", "gpu_index", i, "check", check.name)
+			case nvml.ERROR_NOT_SUPPORTED:
+				logger.Info("self-test read not supported", "gpu_index", i, "check", check.name)
+			default:
+				logger.Error("self-test read failed", "gpu_index", i, "check", check.name, "return", ret)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d NVML reads failed", failed)
+	}
+	return nil
+}
+
+// gpuSelfTestAction runs GPUSelfTest when --collector.nvidia.selftest is passed and exits
+func gpuSelfTestAction(_ *kingpin.ParseContext) error {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if err := GPUSelfTest(logger); err != nil {
+		logger.Error("NVIDIA self-test failed", "err", err)
+		os.Exit(1)
+	}
+	logger.Info("NVIDIA self-test passed")
+	os.Exit(0)
 	return nil
 }
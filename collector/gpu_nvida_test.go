@@ -0,0 +1,1053 @@
+// Copyright 2025 The Prometheus Authors / charliex
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nogpu
+// +build !nogpu
+
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGPUProcessContainerID(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name   string
+		cgroup string
+		want   string
+	}{
+		{
+			name:   "cgroup v1 docker",
+			cgroup: "12:memory:/docker/" + id + "\n11:devices:/docker/" + id + "\n",
+			want:   id,
+		},
+		{
+			name:   "cgroup v1 kubernetes",
+			cgroup: "4:devices:/kubepods/burstable/pod5a4d3c2b-1f0e-4d9c-8b7a-6f5e4d3c2b1a/" + id + "\n",
+			want:   id,
+		},
+		{
+			name:   "cgroup v2 systemd driver",
+			cgroup: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod5a4d3c2b.slice/cri-containerd-" + id + ".scope\n",
+			want:   id,
+		},
+		{
+			name:   "not in a container",
+			cgroup: "0::/user.slice/user-1000.slice/session-2.scope\n",
+			want:   "",
+		},
+	}
+
+	defer func(path string) { *procPath = path }(*procPath)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*procPath = t.TempDir()
+			if err := os.MkdirAll(filepath.Join(*procPath, "42"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(*procPath, "42", "cgroup"), []byte(test.cgroup), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if got := gpuProcessContainerID(42); got != test.want {
+				t.Errorf("want container id %q, got %q", test.want, got)
+			}
+		})
+	}
+
+	*procPath = t.TempDir()
+	if got := gpuProcessContainerID(42); got != "" {
+		t.Errorf("want empty container id for an exited process, got %q", got)
+	}
+}
+
+func TestGPUProcessUID(t *testing.T) {
+	defer func(path string) { *procPath = path }(*procPath)
+	*procPath = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(*procPath, "42"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	status := "Name:\tpython3\nUmask:\t0022\nState:\tS (sleeping)\nUid:\t1000\t0\t0\t0\nGid:\t1000\t1000\t1000\t1000\n"
+	if err := os.WriteFile(filepath.Join(*procPath, "42", "status"), []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := gpuProcessUID(42); got != "1000" {
+		t.Errorf("want the real uid 1000, got %q", got)
+	}
+	if got := gpuProcessUID(43); got != "" {
+		t.Errorf("want empty uid for an exited process, got %q", got)
+	}
+}
+
+func TestGPUTimesliceReplicas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gfd")
+	if err := os.WriteFile(path, []byte("nvidia.com/gpu.product=Tesla-T4-SHARED\nnvidia.com/gpu.replicas=4\nnvidia.com/gpu.sharing-strategy=time-slicing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := gpuTimesliceReplicas(path); err != nil || got != 4 {
+		t.Errorf("want 4 replicas, got %d (%v)", got, err)
+	}
+
+	if err := os.WriteFile(path, []byte("nvidia.com/gpu.product=Tesla-T4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := gpuTimesliceReplicas(path); err != nil || got != 0 {
+		t.Errorf("want 0 replicas without time-slicing, got %d (%v)", got, err)
+	}
+}
+
+func TestGPUCgroupDevices(t *testing.T) {
+	tests := []struct {
+		name  string
+		list  string
+		allow []int
+		deny  []int
+	}{
+		{"single GPU", "c 1:3 rwm\nc 195:1 rw\nc 195:255 rw\nc 10:200 rwm\n", []int{1}, []int{0, 2}},
+		{"all NVIDIA devices", "c 195:* rwm\n", []int{0, 7}, nil},
+		{"unrestricted", "a *:* rwm\n", []int{0, 7}, nil},
+		{"other majors only", "c 136:* rwm\nb 8:1 rw\n", nil, []int{0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "devices.list"), []byte(test.list), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			devices, err := readGPUCgroupDevices(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, minor := range test.allow {
+				if !devices.allows(minor) {
+					t.Errorf("want minor %d allowed", minor)
+				}
+			}
+			for _, minor := range test.deny {
+				if devices.allows(minor) {
+					t.Errorf("want minor %d denied", minor)
+				}
+			}
+		})
+	}
+
+	// cgroup v2 has no device list
+	if _, err := readGPUCgroupDevices(t.TempDir()); err == nil {
+		t.Error("want an error for a cgroup without devices.list")
+	}
+}
+
+func TestGPUDriverNVMLCompatible(t *testing.T) {
+	for _, test := range []struct {
+		nvmlVersion, driverVersion string
+		compatible, ok             bool
+	}{
+		{"12.550.54.15", "550.54.15", true, true},
+		{"12.555.42.02", "550.54.15", false, true},
+		{"11.470.82.01", "470.82.01", true, true},
+		{"12", "550.54.15", false, false},
+	} {
+		compatible, ok := gpuDriverNVMLCompatible(test.nvmlVersion, test.driverVersion)
+		if compatible != test.compatible || ok != test.ok {
+			t.Errorf("NVML %s, driver %s: want compatible %t ok %t, got %t %t", test.nvmlVersion, test.driverVersion, test.compatible, test.ok, compatible, ok)
+		}
+	}
+}
+
+func TestGPUDriverType(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		want    string
+	}{
+		{
+			name:    "open kernel module",
+			version: "NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  550.54.15  Release Build  (dvs-builder@U16-I3-B03-4-3)  Tue Mar  5 19:33:28 UTC 2024\nGCC version:  gcc version 12.2.0 (Debian 12.2.0-14)\n",
+			want:    "open",
+		},
+		{
+			name:    "proprietary kernel module",
+			version: "NVRM version: NVIDIA UNIX x86_64 Kernel Module  550.54.15  Tue Mar  5 22:23:56 UTC 2024\nGCC version:  gcc version 12.2.0 (Debian 12.2.0-14)\n",
+			want:    "proprietary",
+		},
+		{
+			name:    "unrecognised",
+			version: "something else\n",
+			want:    "",
+		},
+	}
+
+	defer func(path string) { *procPath = path }(*procPath)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*procPath = t.TempDir()
+			if err := os.MkdirAll(filepath.Join(*procPath, "driver", "nvidia"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(*procPath, "driver", "nvidia", "version"), []byte(test.version), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if got := gpuDriverType(); got != test.want {
+				t.Errorf("want driver type %q, got %q", test.want, got)
+			}
+		})
+	}
+
+	*procPath = t.TempDir()
+	if got := gpuDriverType(); got != "" {
+		t.Errorf("want empty driver type without the driver loaded, got %q", got)
+	}
+}
+
+func TestParseGPUMetricGroups(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	if err := os.WriteFile(argsFile, []byte("--collector.nvidia.processes\n--collector.nvidia.p2p\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want gpuMetricGroups
+	}{
+		{
+			name: "other flags are ignored",
+			args: []string{"--web.listen-address=:9100", "--collector.nvidia.power-samples", "--no-collector.cpu"},
+			want: gpuMetricGroups{powerSamples: true},
+		},
+		{
+			name: "negated flags",
+			args: []string{"--no-collector.nvidia.processes", "--collector.nvidia.p2p"},
+			want: gpuMetricGroups{p2p: true},
+		},
+		{
+			name: "flags from file",
+			args: []string{"@" + argsFile},
+			want: gpuMetricGroups{processes: true, p2p: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseGPUMetricGroups(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("want metric groups %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseGPULabels(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		pciBusID bool
+		want     []string
+		wantErr  bool
+	}{
+		{value: "gpu_index,gpu_name", want: []string{"gpu_index", "gpu_name"}},
+		{value: "uuid, gpu_index", want: []string{"gpu_index", "uuid"}},
+		{value: "uuid", pciBusID: true, want: []string{"uuid", "pci_bus_id"}},
+		{value: "gpu_index,serial", wantErr: true},
+		{value: "gpu_name", wantErr: true},
+		{value: "", wantErr: true},
+	} {
+		got, err := parseGPULabels(test.value, test.pciBusID)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: want error %t, got %v", test.value, test.wantErr, err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q: want labels %v, got %v", test.value, test.want, got)
+		}
+	}
+}
+
+func TestGPUConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gpu.yml")
+	config := `gpus:
+  - name: "NVIDIA H100.*"
+    groups:
+      processes: false
+      power-samples: true
+  - uuid: GPU-b
+    groups:
+      processes: true
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadGPUConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := gpuMetricGroups{processes: true}
+	for _, test := range []struct {
+		uuid, name string
+		want       gpuMetricGroups
+	}{
+		{"GPU-a", "Tesla T4", gpuMetricGroups{processes: true}},
+		{"GPU-a", "NVIDIA H100 80GB HBM3", gpuMetricGroups{powerSamples: true}},
+		{"GPU-b", "NVIDIA H100 80GB HBM3", gpuMetricGroups{processes: true, powerSamples: true}},
+	} {
+		if got := c.deviceGroups(flags, test.uuid, test.name); got != test.want {
+			t.Errorf("%s %s: want metric groups %+v, got %+v", test.uuid, test.name, test.want, got)
+		}
+	}
+	if got := (*gpuConfig)(nil).deviceGroups(flags, "GPU-a", "Tesla T4"); got != flags {
+		t.Errorf("want the flags without a config file, got %+v", got)
+	}
+
+	for name, data := range map[string]string{
+		"unknown group": "gpus:\n  - uuid: GPU-a\n    groups:\n      fans: true\n",
+		"p2p":           "gpus:\n  - uuid: GPU-a\n    groups:\n      p2p: true\n",
+		"no selector":   "gpus:\n  - groups:\n      processes: true\n",
+		"bad regex":     "gpus:\n  - name: \"(\"\n",
+		"unknown key":   "devices: []\n",
+	} {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadGPUConfig(path); err == nil {
+			t.Errorf("%s: want error loading config", name)
+		}
+	}
+}
+
+func TestGPUCPUList(t *testing.T) {
+	for _, test := range []struct {
+		cpuSet []uint
+		want   string
+	}{
+		{[]uint{0}, ""},
+		{[]uint{0xffff}, "0-15"},
+		{[]uint{0xffff0000ffff}, "0-15,32-47"},
+		{[]uint{0b1011, 1 << 63, 1}, "0-1,3,127-128"},
+	} {
+		if got := gpuCPUList(test.cpuSet); got != test.want {
+			t.Errorf("cpu set %#x: want %q, got %q", test.cpuSet, test.want, got)
+		}
+	}
+}
+
+func TestGPUAERTotal(t *testing.T) {
+	if got, want := gpuSysfsPCIAddress("00000000:3B:00.0"), "0000:3b:00.0"; got != want {
+		t.Errorf("want sysfs address %q, got %q", want, got)
+	}
+	if got := gpuSysfsPCIAddress(""); got != "" {
+		t.Errorf("want empty sysfs address for an unknown bus id, got %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "aer_dev_correctable")
+	counters := "RxErr 0\nBadTLP 3\nBadDLLP 1\nRollover 0\nTimeout 0\nNonFatalErr 0\nCorrIntErr 0\nHeaderOF 0\nTOTAL_ERR_COR 4\n"
+	if err := os.WriteFile(path, []byte(counters), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	total, err := gpuAERTotal(path, "TOTAL_ERR_COR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 {
+		t.Errorf("want 4 correctable errors, got %d", total)
+	}
+	if _, err := gpuAERTotal(path, "TOTAL_ERR_FATAL"); err == nil {
+		t.Error("want error for a missing total line")
+	}
+}
+
+func TestGPUIndexState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gpu-indexes.json")
+
+	state, err := loadGPUIndexState(path)
+	if err != nil {
+		t.Fatalf("want missing state file to be ignored, got %v", err)
+	}
+	for want, uuid := range []string{"GPU-a", "GPU-b"} {
+		if index, _ := state.index(uuid); index != want {
+			t.Errorf("want index %d for %s, got %d", want, uuid, index)
+		}
+	}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reloaded indexes are kept, and new GPUs get the lowest free index
+	if err := os.WriteFile(path, []byte(`{"GPU-a": 0, "GPU-c": 2}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	state, err = loadGPUIndexState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index, assigned := state.index("GPU-c"); index != 2 || assigned {
+		t.Errorf("want persisted index 2 for GPU-c, got %d (assigned %t)", index, assigned)
+	}
+	if index, assigned := state.index("GPU-d"); index != 1 || !assigned {
+		t.Errorf("want new index 1 for GPU-d, got %d (assigned %t)", index, assigned)
+	}
+
+	for name, data := range map[string]string{
+		"corrupt":   "{not json",
+		"duplicate": `{"GPU-a": 0, "GPU-b": 0}`,
+		"negative":  `{"GPU-a": -1}`,
+	} {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		state, err := loadGPUIndexState(path)
+		if err == nil {
+			t.Errorf("%s: want error loading state", name)
+		}
+		if len(state.indexes) != 0 {
+			t.Errorf("%s: want empty state, got %v", name, state.indexes)
+		}
+	}
+}
+
+func TestGPUPrimaryThrottleReason(t *testing.T) {
+	for _, test := range []struct {
+		reasons uint64
+		want    int
+	}{
+		{nvml.ClocksEventReasonNone, gpuThrottleReasonNone},
+		{nvml.ClocksEventReasonGpuIdle, gpuThrottleReasonNone},
+		{nvml.ClocksEventReasonSwPowerCap | nvml.ClocksThrottleReasonHwThermalSlowdown, gpuThrottleReasonThermal},
+		{nvml.ClocksEventReasonSwPowerCap | nvml.ClocksThrottleReasonHwPowerBrakeSlowdown, gpuThrottleReasonPower},
+		{nvml.ClocksEventReasonSwPowerCap | nvml.ClocksEventReasonApplicationsClocksSetting, gpuThrottleReasonSwCap},
+		{nvml.ClocksEventReasonGpuIdle | nvml.ClocksEventReasonApplicationsClocksSetting, gpuThrottleReasonOther},
+	} {
+		if got := gpuPrimaryThrottleReason(test.reasons); got != test.want {
+			t.Errorf("reasons %#x: want %d, got %d", test.reasons, test.want, got)
+		}
+	}
+}
+
+func TestGPUClocksLocked(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+
+	var graphicsClock uint32
+	dev := &gpuDevice{Device: &mock.Device{
+		GetApplicationsClockFunc: func(clockType nvml.ClockType) (uint32, nvml.Return) {
+			if clockType == nvml.CLOCK_GRAPHICS {
+				return graphicsClock, nvml.SUCCESS
+			}
+			return 5001, nvml.SUCCESS
+		},
+		GetDefaultApplicationsClockFunc: func(clockType nvml.ClockType) (uint32, nvml.Return) {
+			if clockType == nvml.CLOCK_GRAPHICS {
+				return 585, nvml.SUCCESS
+			}
+			return 5001, nvml.SUCCESS
+		},
+	}}
+
+	tests := []struct {
+		name          string
+		reasons       uint64
+		graphicsClock uint32
+		want          bool
+	}{
+		{"default clocks", nvml.ClocksEventReasonGpuIdle, 585, false},
+		{"clocks held back", nvml.ClocksEventReasonApplicationsClocksSetting, 585, true},
+		{"idle with applications clocks set", nvml.ClocksEventReasonGpuIdle, 1590, true},
+	}
+	for _, test := range tests {
+		graphicsClock = test.graphicsClock
+		if got := g.clocksLocked(dev, test.reasons); got != test.want {
+			t.Errorf("%s: want %t, got %t", test.name, test.want, got)
+		}
+	}
+}
+
+func TestGPUPowerLimitSource(t *testing.T) {
+	for _, test := range []struct {
+		enforced, defaultLimit uint32
+		reasons                uint64
+		want                   int
+	}{
+		{300000, 300000, nvml.ClocksEventReasonSwPowerCap, gpuPowerLimitSourceDefault},
+		{250000, 300000, nvml.ClocksEventReasonSwPowerCap, gpuPowerLimitSourceUser},
+		{250000, 300000, nvml.ClocksThrottleReasonHwPowerBrakeSlowdown, gpuPowerLimitSourceBrake},
+		{300000, 300000, nvml.ClocksEventReasonSwThermalSlowdown, gpuPowerLimitSourceBrake},
+	} {
+		if got := gpuPowerLimitSource(test.enforced, test.defaultLimit, test.reasons); got != test.want {
+			t.Errorf("enforced %d, default %d, reasons %#x: want %d, got %d", test.enforced, test.defaultLimit, test.reasons, test.want, got)
+		}
+	}
+}
+
+// gpuCollectFunc adapts a single update helper to a prometheus.Collector for testutil
+type gpuCollectFunc struct {
+	desc    *prometheus.Desc
+	collect func(ch chan<- prometheus.Metric)
+}
+
+func (c gpuCollectFunc) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+func (c gpuCollectFunc) Collect(ch chan<- prometheus.Metric) { c.collect(ch) }
+
+func TestGPUVolatileECC(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+
+	var count uint64
+	ret := nvml.SUCCESS
+	dev := &gpuDevice{
+		Device: &mock.Device{
+			GetTotalEccErrorsFunc: func(errorType nvml.MemoryErrorType, counterType nvml.EccCounterType) (uint64, nvml.Return) {
+				if errorType != nvml.MEMORY_ERROR_TYPE_CORRECTED || counterType != nvml.VOLATILE_ECC {
+					t.Errorf("want volatile corrected counter, got error type %d counter type %d", errorType, counterType)
+				}
+				return count, ret
+			},
+		},
+		labels: []string{"0", "Tesla T4"},
+	}
+	c := gpuCollectFunc{g.gpuECCSBEVolatileDesc, func(ch chan<- prometheus.Metric) { g.updateVolatileECC(ch, dev) }}
+
+	for _, count = range []uint64{3, 7} {
+		want := fmt.Sprintf(`# HELP node_gpu_ecc_sbe_volatile_total Number of corrected single bit ECC errors since the driver was last loaded.
+# TYPE node_gpu_ecc_sbe_volatile_total counter
+node_gpu_ecc_sbe_volatile_total{gpu_index="0",gpu_name="Tesla T4"} %d
+`, count)
+		if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// ECC disabled or unsupported GPUs export nothing
+	ret = nvml.ERROR_NOT_SUPPORTED
+	if n := testutil.CollectAndCount(c); n != 0 {
+		t.Errorf("want no metrics for an unsupported GPU, got %d", n)
+	}
+
+	// unless they are asked to be exported as zero
+	*gpuEmitUnsupportedAsZero = true
+	defer func() { *gpuEmitUnsupportedAsZero = false }()
+	g = newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	c = gpuCollectFunc{g.gpuECCSBEVolatileDesc, func(ch chan<- prometheus.Metric) { g.updateVolatileECC(ch, dev) }}
+	want := `# HELP node_gpu_ecc_sbe_volatile_total Number of corrected single bit ECC errors since the driver was last loaded.
+# TYPE node_gpu_ecc_sbe_volatile_total counter
+node_gpu_ecc_sbe_volatile_total{gpu_index="0",gpu_name="Tesla T4",supported="false"} 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGPUExclusiveModeOccupied(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+
+	calls := 0
+	dev := &gpuDevice{
+		Device: &mock.Device{
+			GetComputeModeFunc: func() (nvml.ComputeMode, nvml.Return) {
+				return nvml.COMPUTEMODE_EXCLUSIVE_PROCESS, nvml.SUCCESS
+			},
+			GetComputeRunningProcessesFunc: func() ([]nvml.ProcessInfo, nvml.Return) {
+				calls++
+				return []nvml.ProcessInfo{{Pid: 1, UsedGpuMemory: 1024}}, nvml.SUCCESS
+			},
+			GetGraphicsRunningProcessesFunc: func() ([]nvml.ProcessInfo, nvml.Return) {
+				return nil, nvml.ERROR_NOT_SUPPORTED
+			},
+		},
+		labels: []string{"0", "Tesla T4"},
+	}
+	c := gpuCollectFunc{g.gpuExclusiveModeOccupiedDesc, func(ch chan<- prometheus.Metric) { g.updateExclusiveModeOccupied(ch, dev) }}
+
+	want := `# HELP node_gpu_exclusive_mode_occupied Whether the GPU is in exclusive process compute mode and already has a compute process, so new contexts will be rejected.
+# TYPE node_gpu_exclusive_mode_occupied gauge
+node_gpu_exclusive_mode_occupied{gpu_index="0",gpu_name="Tesla T4"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// the process metrics reuse the compute processes read for the exclusive mode check
+	if processes := g.runningProcesses(dev); len(processes) != 1 {
+		t.Errorf("want 1 process, got %d", len(processes))
+	}
+	if calls != 1 {
+		t.Errorf("want the compute processes read once per scrape, got %d calls", calls)
+	}
+}
+
+func TestGPUNewSamples(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+
+	// a sample taken between the count and fill calls of GetSamples fails the fill with
+	// ERROR_INSUFFICIENT_SIZE, the call is retried
+	failures := 0
+	calls := 0
+	dev := &gpuDevice{
+		Device: &mock.Device{
+			GetSamplesFunc: func(samplingType nvml.SamplingType, lastSeen uint64) (nvml.ValueType, []nvml.Sample, nvml.Return) {
+				calls++
+				if calls <= failures {
+					return nvml.VALUE_TYPE_UNSIGNED_INT, nil, nvml.ERROR_INSUFFICIENT_SIZE
+				}
+				samples := []nvml.Sample{{TimeStamp: 10}, {TimeStamp: 20}}
+				binary.NativeEndian.PutUint32(samples[0].SampleValue[:], 70000)
+				binary.NativeEndian.PutUint32(samples[1].SampleValue[:], 80000)
+				return nvml.VALUE_TYPE_UNSIGNED_INT, samples, nvml.SUCCESS
+			},
+		},
+		state: &gpuDeviceState{samplesLastSeen: make(map[nvml.SamplingType]uint64)},
+	}
+
+	for _, test := range []struct {
+		failures int
+		want     []float64
+	}{
+		{gpuInsufficientSizeAttempts - 1, []float64{70000, 80000}},
+		// the samples are left for the next scrape once the attempts are used up
+		{gpuInsufficientSizeAttempts, nil},
+	} {
+		failures, calls = test.failures, 0
+		if got := g.newSamples(dev, nvml.TOTAL_POWER_SAMPLES); !slices.Equal(got, test.want) {
+			t.Errorf("%d failures: want samples %v, got %v", test.failures, test.want, got)
+		}
+		if calls != min(test.failures+1, gpuInsufficientSizeAttempts) {
+			t.Errorf("%d failures: want %d calls, got %d", test.failures, min(test.failures+1, gpuInsufficientSizeAttempts), calls)
+		}
+	}
+}
+
+func TestGPUUpdateTopology(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	g.events = make(map[string]*gpuEventCounts)
+
+	present := map[string]nvml.Device{"GPU-a": &mock.Device{}, "GPU-b": &mock.Device{}}
+	g.deviceState("GPU-a", "0")
+	g.deviceState("GPU-b", "1")
+	g.deviceState("", "2")
+	g.events["GPU-b"] = &gpuEventCounts{}
+	g.updateTopology(present, len(present))
+	if g.topologyChanges != 0 {
+		t.Errorf("want the first scrape not to count as a change, got %d changes", g.topologyChanges)
+	}
+	if _, ok := g.devices["index:2"]; ok {
+		t.Error("want index keyed state purged once every GPU was identified")
+	}
+
+	g.updateTopology(present, len(present))
+	if g.topologyChanges != 0 {
+		t.Errorf("want no change for the same GPUs, got %d changes", g.topologyChanges)
+	}
+
+	// GPU-b is unplugged and GPU-c attached in its place
+	delete(present, "GPU-b")
+	present["GPU-c"] = &mock.Device{}
+	g.updateTopology(present, len(present))
+	if g.topologyChanges != 1 {
+		t.Errorf("want 1 change, got %d", g.topologyChanges)
+	}
+	if _, ok := g.devices["GPU-b"]; ok {
+		t.Error("want state of the removed GPU purged")
+	}
+	if _, ok := g.events["GPU-b"]; ok {
+		t.Error("want event counts of the removed GPU purged")
+	}
+	if _, ok := g.devices["GPU-a"]; !ok {
+		t.Error("want state of the remaining GPU kept")
+	}
+}
+
+func TestGPUHandleEvent(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	g.events = map[string]*gpuEventCounts{"GPU-a": {}}
+
+	var reasons uint64
+	device := newGPUMockDevice("GPU-a")
+	device.GetCurrentClocksEventReasonsFunc = func() (uint64, nvml.Return) { return reasons, nvml.SUCCESS }
+
+	// a slowdown is counted once when it starts, single bit ECC errors on every event
+	for _, event := range []struct {
+		eventType uint64
+		reasons   uint64
+	}{
+		{nvml.EventTypeClock, nvml.ClocksEventReasonSwThermalSlowdown},
+		{nvml.EventTypeClock, nvml.ClocksEventReasonSwThermalSlowdown},
+		{nvml.EventTypeSingleBitEccError, 0},
+		{nvml.EventTypeClock, 0},
+		{nvml.EventTypeSingleBitEccError, 0},
+		{nvml.EventTypeClock, nvml.ClocksThrottleReasonHwThermalSlowdown},
+	} {
+		reasons = event.reasons
+		g.handleEvent(nvml.EventData{Device: device, EventType: event.eventType})
+	}
+	if counts := g.events["GPU-a"]; counts.thermalCrossings != 2 || counts.sbeEvents != 2 {
+		t.Errorf("want 2 thermal crossings and 2 single bit ECC events, got %d and %d", counts.thermalCrossings, counts.sbeEvents)
+	}
+}
+
+func TestGPUReloadOnSIGHUPStop(t *testing.T) {
+	if gpuArgsFromFile([]string{"--collector.nvidia.processes"}) || !gpuArgsFromFile([]string{"--web.listen-address=:9100", "@/etc/node_exporter/nvidia.flags"}) {
+		t.Error("want only @file arguments to enable the reload")
+	}
+
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	g.running.Add(1)
+	go func() {
+		defer g.running.Done()
+		g.reloadOnSIGHUP(g.stop)
+	}()
+
+	// Close returns once the handler has stopped and released SIGHUP
+	closed := make(chan struct{})
+	go func() {
+		g.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not stop the SIGHUP handler")
+	}
+}
+
+func TestGPUWatchEventsStop(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	set := &mock.EventSet{
+		WaitFunc: func(uint32) (nvml.EventData, nvml.Return) {
+			time.Sleep(time.Millisecond)
+			return nvml.EventData{}, nvml.ERROR_TIMEOUT
+		},
+		FreeFunc: func() nvml.Return { return nvml.SUCCESS },
+	}
+	g.eventSet = set
+	g.running.Add(1)
+	go func() {
+		defer g.running.Done()
+		g.watchEvents(set, g.stop)
+	}()
+
+	// Close returns once the watcher has stopped and freed the event set
+	g.Close()
+	if len(set.FreeCalls()) != 1 {
+		t.Errorf("want the event set freed once, got %d calls", len(set.FreeCalls()))
+	}
+	if g.eventSet != nil {
+		t.Error("want the freed event set cleared, so added GPUs are not registered with it")
+	}
+}
+
+// withGPUMockDevices makes NVML enumerate devices until the end of the test. a nil device fails
+// DeviceGetHandleByIndex with ERROR_GPU_IS_LOST. the returned slice can be changed to add, remove
+// or replace devices between scrapes.
+func withGPUMockDevices(t *testing.T, devices ...nvml.Device) *[]nvml.Device {
+	getCount, getHandle := nvml.DeviceGetCount, nvml.DeviceGetHandleByIndex
+	getDriverVersion, getNVMLVersion := nvml.SystemGetDriverVersion, nvml.SystemGetNVMLVersion
+	t.Cleanup(func() {
+		nvml.DeviceGetCount, nvml.DeviceGetHandleByIndex = getCount, getHandle
+		nvml.SystemGetDriverVersion, nvml.SystemGetNVMLVersion = getDriverVersion, getNVMLVersion
+	})
+
+	nvml.DeviceGetCount = func() (int, nvml.Return) { return len(devices), nvml.SUCCESS }
+	nvml.DeviceGetHandleByIndex = func(index int) (nvml.Device, nvml.Return) {
+		if devices[index] == nil {
+			return nil, nvml.ERROR_GPU_IS_LOST
+		}
+		return devices[index], nvml.SUCCESS
+	}
+	nvml.SystemGetDriverVersion = func() (string, nvml.Return) { return "550.54.15", nvml.SUCCESS }
+	nvml.SystemGetNVMLVersion = func() (string, nvml.Return) { return "12.550.54.15", nvml.SUCCESS }
+	return &devices
+}
+
+// newGPUMockDevice returns a mock device whose methods are all unsupported, except for
+// the core readings a scrape needs and the given overrides
+func newGPUMockDevice(uuid string) *mock.Device {
+	device := &mock.Device{}
+	value := reflect.ValueOf(device).Elem()
+	returnType := reflect.TypeOf(nvml.SUCCESS)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() != reflect.Func {
+			continue
+		}
+		fn := field.Type()
+		field.Set(reflect.MakeFunc(fn, func([]reflect.Value) []reflect.Value {
+			results := make([]reflect.Value, fn.NumOut())
+			for j := range results {
+				results[j] = reflect.Zero(fn.Out(j))
+				if fn.Out(j) == returnType {
+					results[j] = reflect.ValueOf(nvml.ERROR_NOT_SUPPORTED)
+				}
+			}
+			return results
+		}))
+	}
+
+	device.GetNameFunc = func() (string, nvml.Return) { return "Tesla T4", nvml.SUCCESS }
+	device.GetUUIDFunc = func() (string, nvml.Return) { return uuid, nvml.SUCCESS }
+	device.GetUtilizationRatesFunc = func() (nvml.Utilization, nvml.Return) { return nvml.Utilization{Gpu: 50}, nvml.SUCCESS }
+	device.GetTemperatureFunc = func(nvml.TemperatureSensors) (uint32, nvml.Return) { return 60, nvml.SUCCESS }
+	device.GetMemoryInfoFunc = func() (nvml.Memory, nvml.Return) { return nvml.Memory{Total: 16 << 30}, nvml.SUCCESS }
+	return device
+}
+
+func TestGPUSampler(t *testing.T) {
+	device := newGPUMockDevice("GPU-a")
+	withGPUMockDevices(t, device)
+
+	s := newGPUSampler(slog.New(slog.NewTextHandler(io.Discard, nil)), time.Hour)
+	for _, milliwatts := range []uint32{70000, 250000, 100000} {
+		device.GetPowerUsageFunc = func() (uint32, nvml.Return) { return milliwatts, nvml.SUCCESS }
+		s.sample()
+	}
+	windows := s.take("GPU-a")
+	if power := windows.power; power.count != 3 || power.min != 70 || power.max != 250 || power.sum != 420 {
+		t.Errorf("unexpected power window %+v", power)
+	}
+	if utilisation := windows.utilisation; utilisation.count != 3 || utilisation.min != 50 || utilisation.max != 50 {
+		t.Errorf("unexpected utilisation window %+v", utilisation)
+	}
+	if windows := s.take("GPU-a"); windows.power.count != 0 {
+		t.Errorf("want the windows reset by take, got %+v", windows)
+	}
+
+	// Close stops the goroutine and can be called more than once
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	g.startSampler(time.Millisecond)
+	g.Close()
+	g.Close()
+}
+
+func TestGPUUpdateHandleFailure(t *testing.T) {
+	withGPUMockDevices(t, newGPUMockDevice("GPU-a"), nil, newGPUMockDevice("GPU-c"))
+
+	// the devices either side of the failing one are still reported, and the failure is visible
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	want := `# HELP node_gpu_collector_panics_total Number of panics recovered from while collecting the metrics of a GPU.
+# TYPE node_gpu_collector_panics_total counter
+node_gpu_collector_panics_total 0
+# HELP node_gpu_lost Whether NVML reports the GPU as lost (fallen off the bus).
+# TYPE node_gpu_lost gauge
+node_gpu_lost{gpu_index="0",uuid="GPU-a"} 0
+node_gpu_lost{gpu_index="1",uuid=""} 1
+node_gpu_lost{gpu_index="2",uuid="GPU-c"} 0
+# HELP node_gpu_temperature_celsius GPU temperature in Celsius.
+# TYPE node_gpu_temperature_celsius gauge
+node_gpu_temperature_celsius{gpu_index="0",gpu_name="Tesla T4"} 60
+node_gpu_temperature_celsius{gpu_index="2",gpu_name="Tesla T4"} 60
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(want), "node_gpu_collector_panics_total", "node_gpu_lost", "node_gpu_temperature_celsius"); err != nil {
+		t.Error(err)
+	}
+
+	// the failed call is counted, and only fails the scrape with --collector.nvidia.error-policy=fail
+	want = `# HELP node_gpu_nvml_errors_total Number of core NVML calls of each category that failed with an error other than not supported.
+# TYPE node_gpu_nvml_errors_total counter
+node_gpu_nvml_errors_total{call="handle"} 2
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(want), "node_gpu_nvml_errors_total"); err != nil {
+		t.Error(err)
+	}
+	defer func(policy string) { *gpuErrorPolicy = policy }(*gpuErrorPolicy)
+	for policy, wantErr := range map[string]bool{"count": false, "fail": true} {
+		*gpuErrorPolicy = policy
+		ch := make(chan prometheus.Metric)
+		go func() {
+			for range ch {
+			}
+		}()
+		err := g.Update(ch)
+		close(ch)
+		if (err != nil) != wantErr {
+			t.Errorf("error policy %s: want error %t, got %v", policy, wantErr, err)
+		}
+	}
+}
+
+func TestGPUUpdateRemoval(t *testing.T) {
+	a, b := newGPUMockDevice("GPU-a"), newGPUMockDevice("GPU-b")
+	devices := withGPUMockDevices(t, a, b)
+
+	sample := &mock.GpmSample{FreeFunc: func() nvml.Return { return nvml.SUCCESS }}
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	const help = `# HELP node_gpu_lost Whether NVML reports the GPU as lost (fallen off the bus).
+# TYPE node_gpu_lost gauge
+`
+	for _, step := range []struct {
+		name    string
+		devices []nvml.Device
+		want    string
+	}{
+		{"initial", []nvml.Device{a, b}, `node_gpu_lost{gpu_index="0",uuid="GPU-a"} 0
+node_gpu_lost{gpu_index="1",uuid="GPU-b"} 0
+`},
+		// GPU-a is hot-removed and GPU-b re-enumerated at index 0
+		{"removed", []nvml.Device{b}, `node_gpu_lost{gpu_index="0",uuid="GPU-b"} 0
+`},
+		{"re-added", []nvml.Device{b, a}, `node_gpu_lost{gpu_index="0",uuid="GPU-b"} 0
+node_gpu_lost{gpu_index="1",uuid="GPU-a"} 0
+`},
+	} {
+		*devices = step.devices
+		if err := testutil.CollectAndCompare(g, strings.NewReader(help+step.want), "node_gpu_lost"); err != nil {
+			t.Errorf("%s: %v", step.name, err)
+		}
+		if step.name == "initial" {
+			g.devices["GPU-a"].gpmSample = sample
+		}
+	}
+
+	// the GPM sample of the removed GPU is freed with its state
+	if len(sample.FreeCalls()) != 1 {
+		t.Errorf("want the GPM sample of the removed GPU freed once, got %d calls", len(sample.FreeCalls()))
+	}
+}
+
+func TestGPUUpdateScrapeFailure(t *testing.T) {
+	noUUID := newGPUMockDevice("GPU-b")
+	noUUID.GetUUIDFunc = func() (string, nvml.Return) { return "", nvml.ERROR_UNKNOWN }
+	devices := withGPUMockDevices(t, newGPUMockDevice("GPU-a"), newGPUMockDevice("GPU-b"))
+
+	defer func(window int) { *gpuScrapeSuccessWindow = window }(*gpuScrapeSuccessWindow)
+	*gpuScrapeSuccessWindow = 10
+
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	const help = `# HELP node_gpu_scrape_success_ratio Fraction of the recent scrapes, up to --collector.nvidia.scrape-success-window, in which the core readings of the GPU succeeded.
+# TYPE node_gpu_scrape_success_ratio gauge
+`
+	for _, step := range []struct {
+		name   string
+		device nvml.Device
+		want   string
+	}{
+		{"initial", (*devices)[1], `node_gpu_scrape_success_ratio{gpu_index="0",gpu_name="Tesla T4"} 1
+node_gpu_scrape_success_ratio{gpu_index="1",gpu_name="Tesla T4"} 1
+`},
+		// the failures are recorded against the GPU last seen at index 1
+		{"handle failure", nil, `node_gpu_scrape_success_ratio{gpu_index="0",gpu_name="Tesla T4"} 1
+node_gpu_scrape_success_ratio{gpu_index="1",gpu_name="Tesla T4"} 0.5
+`},
+		{"uuid failure", noUUID, `node_gpu_scrape_success_ratio{gpu_index="0",gpu_name="Tesla T4"} 1
+node_gpu_scrape_success_ratio{gpu_index="1",gpu_name="Tesla T4"} 0.3333333333333333
+`},
+	} {
+		(*devices)[1] = step.device
+		if err := testutil.CollectAndCompare(g, strings.NewReader(help+step.want), "node_gpu_scrape_success_ratio"); err != nil {
+			t.Errorf("%s: %v", step.name, err)
+		}
+	}
+}
+
+func TestGPUUpdateUUIDLabelOnly(t *testing.T) {
+	var devices []nvml.Device
+	for _, uuid := range []string{"GPU-a", "GPU-b", "GPU-c"} {
+		device := newGPUMockDevice(uuid)
+		if uuid != "GPU-a" {
+			device.GetUUIDFunc = func() (string, nvml.Return) { return "", nvml.ERROR_UNKNOWN }
+		}
+		devices = append(devices, device)
+	}
+	withGPUMockDevices(t, devices...)
+
+	// the GPUs without a UUID would both be labelled uuid="", so they are left out
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"uuid"})
+	want := `# HELP node_gpu_temperature_celsius GPU temperature in Celsius.
+# TYPE node_gpu_temperature_celsius gauge
+node_gpu_temperature_celsius{uuid="GPU-a"} 60
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(want), "node_gpu_temperature_celsius"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGPUUpdateCgroup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "devices.list"), []byte("c 195:0 rw\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(cgroup string) { *gpuCgroup = cgroup }(*gpuCgroup)
+	*gpuCgroup = dir
+
+	allowed, neighbour := newGPUMockDevice("GPU-a"), newGPUMockDevice("GPU-c")
+	allowed.GetMinorNumberFunc = func() (int, nvml.Return) { return 0, nvml.SUCCESS }
+	neighbour.GetMinorNumberFunc = func() (int, nvml.Return) { return 2, nvml.SUCCESS }
+	// the neighbour at index 1 cannot be identified
+	withGPUMockDevices(t, allowed, nil, neighbour)
+
+	// only the GPU the cgroup may access is counted and reported
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+	want := `# HELP node_gpu_count Number of NVIDIA GPUs found by NVML, excluding the ones --collector.nvidia.cgroup may not access.
+# TYPE node_gpu_count gauge
+node_gpu_count 1
+# HELP node_gpu_lost Whether NVML reports the GPU as lost (fallen off the bus).
+# TYPE node_gpu_lost gauge
+node_gpu_lost{gpu_index="0",uuid="GPU-a"} 0
+# HELP node_gpu_model_count Number of NVIDIA GPUs found by NVML per model.
+# TYPE node_gpu_model_count gauge
+node_gpu_model_count{gpu_name="Tesla T4"} 1
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(want), "node_gpu_count", "node_gpu_lost", "node_gpu_model_count"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGPUCollectorDescribe(t *testing.T) {
+	g := newGPUCollector(slog.New(slog.NewTextHandler(io.Discard, nil)), []string{"gpu_index", "gpu_name"})
+
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		g.Describe(ch)
+		close(ch)
+	}()
+	described := make(map[*prometheus.Desc]bool)
+	for desc := range ch {
+		described[desc] = true
+	}
+
+	descType := reflect.TypeOf((*prometheus.Desc)(nil))
+	value := reflect.ValueOf(g).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Type != descType {
+			continue
+		}
+		desc := (*prometheus.Desc)(value.Field(i).UnsafePointer())
+		if desc == nil {
+			t.Errorf("descriptor %s is not initialised", field.Name)
+			continue
+		}
+		if !described[desc] {
+			t.Errorf("descriptor %s is not sent by Describe", field.Name)
+		}
+	}
+
+	callDurations := make(chan *prometheus.Desc, 1)
+	g.callDurations.Describe(callDurations)
+	if !described[<-callDurations] {
+		t.Error("call duration descriptor is not sent by Describe")
+	}
+}
@@ -33,7 +33,10 @@ require (
 	howett.net/plist v1.0.1
 )
 
-require github.com/NVIDIA/go-nvml v0.12.4-1
+require (
+	github.com/NVIDIA/go-nvml v0.12.4-1
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
 	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137 // indirect
@@ -59,7 +62,6 @@ require (
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/protobuf v1.36.1 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
 
 //replace github.com/prometheus/procfs => github.com/rexagod/procfs v0.0.0-20241124020414-857c5b813f1b